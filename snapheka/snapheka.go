@@ -24,9 +24,15 @@ import (
 	"encoding/gob"
 	"encoding/json"
 	"fmt"
-	"net/url"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/mozilla-services/heka/message"
 
 	"github.com/intelsdi-x/snap/control/plugin"
 	"github.com/intelsdi-x/snap/control/plugin/cpolicy"
@@ -39,6 +45,10 @@ const (
 	pluginName = "heka"
 	version    = 3
 	pluginType = plugin.PublisherPluginType
+
+	// Time after which the client of a task config which is not used
+	// anymore is closed
+	dfltClientExpiry = time.Hour
 )
 
 // Meta returns a plugin meta data
@@ -56,10 +66,22 @@ func Meta() *plugin.PluginMeta {
 
 //NewHekaPublisher returns an instance of the Heka publisher
 func NewHekaPublisher() *hekaPublisher {
-	return &hekaPublisher{}
+	return &hekaPublisher{
+		clients:  make(map[string]*SnapHekaClient),
+		lastUsed: make(map[string]time.Time),
+		expiry:   dfltClientExpiry,
+	}
 }
 
 type hekaPublisher struct {
+	mutex sync.Mutex
+	// Heka clients by task config, kept between Publish calls
+	// so that endpoint health and other state is preserved
+	clients map[string]*SnapHekaClient
+	// Last Publish call of each task config, the clients unused for
+	// longer than expiry are closed
+	lastUsed map[string]time.Time
+	expiry   time.Duration
 }
 
 // GetConfigPolicy returns the config of the Heka plugin
@@ -67,14 +89,14 @@ func (p *hekaPublisher) GetConfigPolicy() (*cpolicy.ConfigPolicy, error) {
 	cp := cpolicy.New()
 	config := cpolicy.NewPolicyNode()
 
-	r1, err := cpolicy.NewStringRule("host", true)
+	r1, err := cpolicy.NewStringRule("host", false)
 	handleErr(err)
-	r1.Description = "Heka host"
+	r1.Description = "Heka host (required unless socket-path is set)"
 	config.Add(r1)
 
-	r2, err := cpolicy.NewIntegerRule("port", true)
+	r2, err := cpolicy.NewIntegerRule("port", false)
 	handleErr(err)
-	r2.Description = "Heka port"
+	r2.Description = "Heka port (required unless socket-path is set)"
 	config.Add(r2)
 
 	r3, err := cpolicy.NewStringRule("mappings-file", false)
@@ -82,6 +104,386 @@ func (p *hekaPublisher) GetConfigPolicy() (*cpolicy.ConfigPolicy, error) {
 	r3.Description = "Heka plugin mappings JSON/XML file"
 	config.Add(r3)
 
+	r4, err := cpolicy.NewIntegerRule("retry-max-attempts", false, dfltRetryMaxAttempts)
+	handleErr(err)
+	r4.Description = "Maximum number of attempts to send a message to Heka"
+	config.Add(r4)
+
+	r5, err := cpolicy.NewStringRule("retry-backoff", false, dfltRetryBackoff.String())
+	handleErr(err)
+	r5.Description = "Delay before the first retry, doubled at every retry (e.g. 100ms)"
+	config.Add(r5)
+
+	r6, err := cpolicy.NewStringRule("retry-max-backoff", false, dfltRetryMaxBackoff.String())
+	handleErr(err)
+	r6.Description = "Maximum delay between two retries (e.g. 5s)"
+	config.Add(r6)
+
+	r7, err := cpolicy.NewBoolRule("use-tls", false, false)
+	handleErr(err)
+	r7.Description = "Connect to Heka TcpInput using TLS"
+	config.Add(r7)
+
+	r8, err := cpolicy.NewStringRule("tls-ca-file", false)
+	handleErr(err)
+	r8.Description = "PEM bundle of the CAs used to verify the Heka certificate"
+	config.Add(r8)
+
+	r9, err := cpolicy.NewStringRule("tls-cert-file", false)
+	handleErr(err)
+	r9.Description = "PEM client certificate for mutual TLS"
+	config.Add(r9)
+
+	r10, err := cpolicy.NewStringRule("tls-key-file", false)
+	handleErr(err)
+	r10.Description = "PEM client private key for mutual TLS"
+	config.Add(r10)
+
+	r11, err := cpolicy.NewStringRule("tls-server-name", false)
+	handleErr(err)
+	r11.Description = "Server name expected in the Heka certificate (defaults to host)"
+	config.Add(r11)
+
+	r12, err := cpolicy.NewBoolRule("tls-insecure-skip-verify", false, false)
+	handleErr(err)
+	r12.Description = "Do not verify the Heka certificate (testing only)"
+	config.Add(r12)
+
+	r13, err := cpolicy.NewStringRule("tls-min-version", false, dfltTLSMinVersion)
+	handleErr(err)
+	r13.Description = "Minimum TLS version (1.0, 1.1 or 1.2)"
+	config.Add(r13)
+
+	r14, err := cpolicy.NewStringRule("protocol", false, "tcp")
+	handleErr(err)
+	r14.Description = "Transport protocol to Heka: tcp (TcpInput) or udp (UdpInput)"
+	config.Add(r14)
+
+	r15, err := cpolicy.NewIntegerRule("udp-max-size", false, SnapDfltUDPMaxSize)
+	handleErr(err)
+	r15.Description = "Maximum size in bytes of a framed message sent over UDP or unixgram"
+	config.Add(r15)
+
+	r16, err := cpolicy.NewStringRule("socket-path", false)
+	handleErr(err)
+	r16.Description = "Path of the Heka unix domain socket, used instead of host and port"
+	config.Add(r16)
+
+	r17, err := cpolicy.NewStringRule("endpoints", false)
+	handleErr(err)
+	r17.Description = "Comma separated list of Heka host:port, used instead of host and port"
+	config.Add(r17)
+
+	r18, err := cpolicy.NewStringRule("endpoint-strategy", false, dfltEndpointStrategy)
+	handleErr(err)
+	r18.Description = "How messages are spread over endpoints: failover, round-robin or hash"
+	config.Add(r18)
+
+	r19, err := cpolicy.NewStringRule("endpoint-cooldown", false, dfltEndpointCooldown.String())
+	handleErr(err)
+	r19.Description = "How long an endpoint which failed is avoided (e.g. 30s)"
+	config.Add(r19)
+
+	r20, err := cpolicy.NewStringRule("signer-name", false)
+	handleErr(err)
+	r20.Description = "Name of the signer of Heka messages, messages are not signed when empty"
+	config.Add(r20)
+
+	r21, err := cpolicy.NewIntegerRule("signer-key-version", false, 0)
+	handleErr(err)
+	r21.Description = "Version of the HMAC key of the signer"
+	config.Add(r21)
+
+	r22, err := cpolicy.NewStringRule("signer-hash", false, dfltSignerHash)
+	handleErr(err)
+	r22.Description = "HMAC hash function: md5 or sha1"
+	config.Add(r22)
+
+	r23, err := cpolicy.NewStringRule("signer-key-file", false)
+	handleErr(err)
+	r23.Description = "File holding the HMAC key of the signer"
+	config.Add(r23)
+
+	r24, err := cpolicy.NewStringRule("signer-key-env", false)
+	handleErr(err)
+	r24.Description = "Environment variable holding the HMAC key of the signer"
+	config.Add(r24)
+
+	r25, err := cpolicy.NewIntegerRule("batch-max-bytes", false, SnapDfltBatchMaxBytes)
+	handleErr(err)
+	r25.Description = "Maximum number of bytes of framed messages written at once"
+	config.Add(r25)
+
+	r26, err := cpolicy.NewIntegerRule("batch-max-messages", false, SnapDfltBatchMaxMessages)
+	handleErr(err)
+	r26.Description = "Maximum number of messages written at once (1 disables batching)"
+	config.Add(r26)
+
+	r27, err := cpolicy.NewBoolRule("async", false, false)
+	handleErr(err)
+	r27.Description = "Queue metrics and send them in the background instead of during Publish"
+	config.Add(r27)
+
+	r28, err := cpolicy.NewIntegerRule("queue-size", false, dfltQueueSize)
+	handleErr(err)
+	r28.Description = "Maximum number of metrics waiting to be sent in async mode"
+	config.Add(r28)
+
+	r29, err := cpolicy.NewStringRule("queue-overflow", false, dfltQueueOverflow)
+	handleErr(err)
+	r29.Description = "What to do when the queue is full: block, drop-oldest or drop-newest"
+	config.Add(r29)
+
+	r30, err := cpolicy.NewStringRule("spool-dir", false, "")
+	handleErr(err)
+	r30.Description = "Directory where messages are kept while Heka is unreachable (spooling is disabled when empty)"
+	config.Add(r30)
+
+	r31, err := cpolicy.NewIntegerRule("spool-max-bytes", false, dfltSpoolMaxBytes)
+	handleErr(err)
+	r31.Description = "Maximum size of the spool, the oldest messages are dropped beyond it"
+	config.Add(r31)
+
+	r32, err := cpolicy.NewIntegerRule("spool-segment-bytes", false, dfltSpoolSegmentBytes)
+	handleErr(err)
+	r32.Description = "Maximum size of a spool segment file"
+	config.Add(r32)
+
+	r33, err := cpolicy.NewStringRule("spool-max-age", false, dfltSpoolMaxAge.String())
+	handleErr(err)
+	r33.Description = "How long spooled messages are kept (e.g. 24h, 0 to keep them until sent)"
+	config.Add(r33)
+
+	r34, err := cpolicy.NewStringRule("spool-fsync", false, dfltSpoolFsync)
+	handleErr(err)
+	r34.Description = "When spool writes are synced to disk: always, segment or never"
+	config.Add(r34)
+
+	r35, err := cpolicy.NewStringRule("connect-timeout", false, dfltConnectTimeout.String())
+	handleErr(err)
+	r35.Description = "Maximum time to connect to Heka, including the TLS handshake (0 to wait forever)"
+	config.Add(r35)
+
+	r36, err := cpolicy.NewStringRule("write-timeout", false, dfltWriteTimeout.String())
+	handleErr(err)
+	r36.Description = "Maximum time to write messages to Heka (0 to wait forever)"
+	config.Add(r36)
+
+	r37, err := cpolicy.NewStringRule("idle-timeout", false, dfltIdleTimeout.String())
+	handleErr(err)
+	r37.Description = "Connections unused for this long are closed and opened again (0 to keep them open)"
+	config.Add(r37)
+
+	r38, err := cpolicy.NewStringRule("dns-refresh", false, dfltDNSRefresh.String())
+	handleErr(err)
+	r38.Description = "How often Heka hostnames and the SRV record are looked up again (0 to only resolve when connecting)"
+	config.Add(r38)
+
+	r39, err := cpolicy.NewStringRule("srv-record", false, "")
+	handleErr(err)
+	r39.Description = "DNS SRV record listing the Heka endpoints (e.g. _heka._tcp.example.com), used instead of host and port"
+	config.Add(r39)
+
+	r40, err := cpolicy.NewIntegerRule("rate-limit-messages", false, 0)
+	handleErr(err)
+	r40.Description = "Maximum number of messages sent to Heka per second (0 for no limit)"
+	config.Add(r40)
+
+	r41, err := cpolicy.NewIntegerRule("rate-limit-bytes", false, 0)
+	handleErr(err)
+	r41.Description = "Maximum number of bytes sent to Heka per second (0 for no limit)"
+	config.Add(r41)
+
+	r42, err := cpolicy.NewStringRule("rate-limit-mode", false, dfltRateLimitMode)
+	handleErr(err)
+	r42.Description = "What to do with messages over the rate limits: delay or drop"
+	config.Add(r42)
+
+	r43, err := cpolicy.NewIntegerRule("max-message-size", false, SnapDfltMaxMessageSize)
+	handleErr(err)
+	r43.Description = "Largest message accepted by hekad, as its max_message_size setting"
+	config.Add(r43)
+
+	r44, err := cpolicy.NewStringRule("oversize-strategy", false, dfltOversizeStrategy)
+	handleErr(err)
+	r44.Description = "What to do with larger messages: truncate (the payload), drop-payload or reject"
+	config.Add(r44)
+
+	r45, err := cpolicy.NewStringRule("http-path", false, dfltHTTPPath)
+	handleErr(err)
+	r45.Description = "Path of the Heka HttpListenInput with protocol http"
+	config.Add(r45)
+
+	r46, err := cpolicy.NewStringRule("http-format", false, dfltHTTPFormat)
+	handleErr(err)
+	r46.Description = "Body of the HTTP requests: protobuf (framed Heka messages) or json (one message per line)"
+	config.Add(r46)
+
+	r47, err := cpolicy.NewStringRule("http-headers", false, "")
+	handleErr(err)
+	r47.Description = "JSON object of the headers added to the HTTP requests"
+	config.Add(r47)
+
+	r48, err := cpolicy.NewBoolRule("http-gzip", false, false)
+	handleErr(err)
+	r48.Description = "Compress the body of the HTTP requests with gzip"
+	config.Add(r48)
+
+	r49, err := cpolicy.NewStringRule("http-username", false, "")
+	handleErr(err)
+	r49.Description = "User name for HTTP basic authentication"
+	config.Add(r49)
+
+	r50, err := cpolicy.NewStringRule("http-password-file", false, "")
+	handleErr(err)
+	r50.Description = "File holding the password for HTTP basic authentication"
+	config.Add(r50)
+
+	r51, err := cpolicy.NewStringRule("http-password-env", false, "")
+	handleErr(err)
+	r51.Description = "Environment variable holding the password for HTTP basic authentication"
+	config.Add(r51)
+
+	r52, err := cpolicy.NewStringRule("timestamp-source", false, dfltTimestampSource)
+	handleErr(err)
+	r52.Description = "Time used as the Timestamp of the Heka messages: publish, collection or both (collection, with the publish time in a field)"
+	config.Add(r52)
+
+	r53, err := cpolicy.NewStringRule("timestamp-invalid", false, dfltTimestampInvalid)
+	handleErr(err)
+	r53.Description = "What to do with zero or future collection times: publish (use the publish time), keep or reject"
+	config.Add(r53)
+
+	r54, err := cpolicy.NewStringRule("timestamp-max-future", false, dfltTimestampMaxFuture.String())
+	handleErr(err)
+	r54.Description = "How far ahead of the publish time a collection time is still valid"
+	config.Add(r54)
+
+	r55, err := cpolicy.NewStringRule("payload-format", false, dfltPayloadFormat)
+	handleErr(err)
+	r55.Description = "Payload of the Heka messages: snap-json, none, value, graphite, influx or template"
+	config.Add(r55)
+
+	r56, err := cpolicy.NewStringRule("payload-template", false, "")
+	handleErr(err)
+	r56.Description = "Go text/template executed on the metric to build the Payload with payload-format template"
+	config.Add(r56)
+
+	r57, err := cpolicy.NewStringRule("numeric-overflow", false, dfltNumericOverflow)
+	handleErr(err)
+	r57.Description = "How unsigned integers larger than the largest int64 are sent: saturate, double or string"
+	config.Add(r57)
+
+	r58, err := cpolicy.NewBoolRule("flatten", false, false)
+	handleErr(err)
+	r58.Description = "Expand maps, slices and structs in the metric data into several fields"
+	config.Add(r58)
+
+	r59, err := cpolicy.NewIntegerRule("flatten-max-depth", false, dfltFlattenMaxDepth)
+	handleErr(err)
+	r59.Description = "Number of nested levels expanded, deeper data is sent as JSON text"
+	config.Add(r59)
+
+	r60, err := cpolicy.NewIntegerRule("flatten-max-fields", false, dfltFlattenMaxFields)
+	handleErr(err)
+	r60.Description = "Maximum number of fields a metric is flattened into, the others are dropped"
+	config.Add(r60)
+
+	r61, err := cpolicy.NewBoolRule("unit-field", false, false)
+	handleErr(err)
+	r61.Description = "Add the unit of the metric in a unit field"
+	config.Add(r61)
+
+	r62, err := cpolicy.NewBoolRule("description-field", false, false)
+	handleErr(err)
+	r62.Description = "Add the description of the metric in a description field"
+	config.Add(r62)
+
+	r63, err := cpolicy.NewBoolRule("version-field", false, false)
+	handleErr(err)
+	r63.Description = "Add the version of the metric in a metric_version field"
+	config.Add(r63)
+
+	r64, err := cpolicy.NewStringRule("tag-prefix", false, "")
+	handleErr(err)
+	r64.Description = "Prefix of the names of the fields of the metric tags"
+	config.Add(r64)
+
+	r65, err := cpolicy.NewStringRule("dimension-prefix", false, "")
+	handleErr(err)
+	r65.Description = "Prefix of the names of the fields of the dynamic namespace elements"
+	config.Add(r65)
+
+	r66, err := cpolicy.NewStringRule("reserved-collision", false, dfltReservedCollision)
+	handleErr(err)
+	r66.Description = "What to do with tags and dynamic elements named like a field of the plugin: rename, drop or reject"
+	config.Add(r66)
+
+	r67, err := cpolicy.NewStringRule("field-override", false, dfltFieldOverride)
+	handleErr(err)
+	r67.Description = "Which is kept of a dynamic element and a tag with the same name: dimension or tag"
+	config.Add(r67)
+
+	r68, err := cpolicy.NewStringRule("tag-include", false, "")
+	handleErr(err)
+	r68.Description = "Comma separated glob patterns of the tags added as fields (all when empty)"
+	config.Add(r68)
+
+	r69, err := cpolicy.NewStringRule("tag-exclude", false, "")
+	handleErr(err)
+	r69.Description = "Comma separated glob patterns of the tags not added as fields"
+	config.Add(r69)
+
+	r70, err := cpolicy.NewStringRule("dimension-include", false, "")
+	handleErr(err)
+	r70.Description = "Comma separated glob patterns of the dynamic namespace elements added as fields (all when empty)"
+	config.Add(r70)
+
+	r71, err := cpolicy.NewStringRule("dimension-exclude", false, "")
+	handleErr(err)
+	r71.Description = "Comma separated glob patterns of the dynamic namespace elements not added as fields"
+	config.Add(r71)
+
+	r72, err := cpolicy.NewStringRule("field-include", false, "")
+	handleErr(err)
+	r72.Description = "Comma separated glob patterns of the fields of the plugin added to the messages (all when empty)"
+	config.Add(r72)
+
+	r73, err := cpolicy.NewStringRule("field-exclude", false, "")
+	handleErr(err)
+	r73.Description = "Comma separated glob patterns of the fields of the plugin not added to the messages"
+	config.Add(r73)
+
+	r74, err := cpolicy.NewStringRule("static-fields", false, "")
+	handleErr(err)
+	r74.Description = "JSON object of the constant fields added to every message, field.<name> keys add single fields"
+	config.Add(r74)
+
+	r75, err := cpolicy.NewBoolRule("static-dimensions", false, false)
+	handleErr(err)
+	r75.Description = "List the static fields in the dimensions field"
+	config.Add(r75)
+
+	r76, err := cpolicy.NewStringRule("hostname", false)
+	handleErr(err)
+	r76.Description = "Fixed Hostname of the Heka messages"
+	config.Add(r76)
+
+	r77, err := cpolicy.NewStringRule("hostname-source", false, dfltHostnameSource)
+	handleErr(err)
+	r77.Description = "Comma separated sources of the Hostname tried in order: tag:<name>, dimension:<name>, hostname or os"
+	config.Add(r77)
+
+	r78, err := cpolicy.NewIntegerRule("pid", false)
+	handleErr(err)
+	r78.Description = "Fixed Pid of the Heka messages"
+	config.Add(r78)
+
+	r79, err := cpolicy.NewStringRule("pid-source", false, dfltPidSource)
+	handleErr(err)
+	r79.Description = "Comma separated sources of the Pid tried in order: tag:<name>, dimension:<name>, pid or os"
+	config.Add(r79)
+
 	cp.Add([]string{vendor, pluginName}, config)
 	return cp, nil
 }
@@ -109,19 +511,292 @@ func (p *hekaPublisher) Publish(contentType string, content []byte, config map[s
 		return fmt.Errorf("Unknown content type '%s'", contentType)
 	}
 
-	u, err := url.Parse(fmt.Sprintf("%s:%d", config["host"].(ctypes.ConfigValueStr).Value, config["port"].(ctypes.ConfigValueInt).Value))
-	handleErr(err)
-	mappingsFile := ""
-	if mFile, ok := config["mappings-file"]; ok {
-		mappingsFile = mFile.(ctypes.ConfigValueStr).Value
+	shc, err := p.getClient(config)
+	if err != nil {
+		logger.Printf("Error in Heka client configuration: %v", err)
+		return err
 	}
+	return shc.publish(metrics)
+}
 
-	// Publish metric data to Heka through TCP
-	shc, _ := NewSnapHekaClient(fmt.Sprintf("tcp://%s", u), mappingsFile)
-	err = shc.sendToHeka(metrics)
-	handleErr(err)
+// getClient returns the Heka client for the task config, creating it
+// on the first Publish call
+func (p *hekaPublisher) getClient(config map[string]ctypes.ConfigValue) (*SnapHekaClient, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
 
-	return nil
+	now := time.Now()
+	key := configKey(config)
+	p.expire(now, key)
+	if shc, ok := p.clients[key]; ok {
+		p.lastUsed[key] = now
+		return shc, nil
+	}
+	shc, err := newClientFromConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	p.clients[key] = shc
+	p.lastUsed[key] = now
+	return shc, nil
+}
+
+// expire closes the clients of the task configs other than key which
+// were not used for longer than the expiry, e.g. those of stopped tasks
+func (p *hekaPublisher) expire(now time.Time, key string) {
+	for k, shc := range p.clients {
+		if k != key && now.Sub(p.lastUsed[k]) > p.expiry {
+			logger.WithField("_block", "expire").Debug(
+				fmt.Sprintf("Closing Heka client unused since %v", p.lastUsed[k]))
+			shc.close()
+			delete(p.clients, k)
+			delete(p.lastUsed, k)
+		}
+	}
+}
+
+// configKey returns a string identifying the task config
+func configKey(config map[string]ctypes.ConfigValue) string {
+	keys := make([]string, 0, len(config))
+	for k := range config {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		parts = append(parts, fmt.Sprintf("%s=%#v", k, config[k]))
+	}
+	return strings.Join(parts, ";")
+}
+
+// newClientFromConfig creates a Heka client from the task config
+func newClientFromConfig(config map[string]ctypes.ConfigValue) (*SnapHekaClient, error) {
+	mappingsFile := configString(config, "mappings-file", "")
+
+	retry, err := retryPolicyFromConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := tlsConfigFromConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	addr, err := hekaAddress(config, tlsConfig != nil)
+	if err != nil {
+		return nil, err
+	}
+	udpMaxSize := configInt(config, "udp-max-size", SnapDfltUDPMaxSize)
+	if udpMaxSize < 1 || udpMaxSize > SnapDfltUDPMaxSize {
+		return nil, fmt.Errorf("udp-max-size must be between 1 and %d, got %d", SnapDfltUDPMaxSize, udpMaxSize)
+	}
+	cooldown, err := configDuration(config, "endpoint-cooldown", dfltEndpointCooldown)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := signerFromConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	connectTimeout, err := configDuration(config, "connect-timeout", dfltConnectTimeout)
+	if err != nil {
+		return nil, err
+	}
+	writeTimeout, err := configDuration(config, "write-timeout", dfltWriteTimeout)
+	if err != nil {
+		return nil, err
+	}
+	idleTimeout, err := configDuration(config, "idle-timeout", dfltIdleTimeout)
+	if err != nil {
+		return nil, err
+	}
+	dnsRefresh, err := configDuration(config, "dns-refresh", dfltDNSRefresh)
+	if err != nil {
+		return nil, err
+	}
+	maxMessageSize := configInt(config, "max-message-size", SnapDfltMaxMessageSize)
+	if maxMessageSize < 1 || maxMessageSize > int(message.MAX_MESSAGE_SIZE) {
+		return nil, fmt.Errorf("max-message-size must be between 1 and %d, got %d",
+			message.MAX_MESSAGE_SIZE, maxMessageSize)
+	}
+	oversizeStrategy := configString(config, "oversize-strategy", dfltOversizeStrategy)
+	switch oversizeStrategy {
+	case oversizeTruncate, oversizeDropPayload, oversizeReject:
+	default:
+		return nil, fmt.Errorf("unknown oversize-strategy '%s' (should be one of %s %s %s)",
+			oversizeStrategy, oversizeTruncate, oversizeDropPayload, oversizeReject)
+	}
+	timestamps, err := timestampPolicyFromConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	fields, err := fieldOptionsFromConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	origin, err := originPolicyFromConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := payloadFormatterFromConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	httpOpts, err := httpOptionsFromConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	limiter, err := rateLimiterFromConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	spool, err := spoolFromConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	batchMaxBytes := configInt(config, "batch-max-bytes", SnapDfltBatchMaxBytes)
+	batchMaxMessages := configInt(config, "batch-max-messages", SnapDfltBatchMaxMessages)
+	if batchMaxBytes < 1 || batchMaxMessages < 1 {
+		return nil, fmt.Errorf("batch-max-bytes and batch-max-messages must be at least 1")
+	}
+
+	// Publish metric data to Heka through TCP (optionally over TLS), UDP
+	// or a unix domain socket
+	shc, err := NewSnapHekaClient(addr, mappingsFile)
+	if err != nil {
+		return nil, err
+	}
+	strategy := configString(config, "endpoint-strategy", dfltEndpointStrategy)
+	if shc.balancer, err = newBalancer(strategy, shc.hekaHosts, cooldown); err != nil {
+		return nil, err
+	}
+	shc.retry = retry
+	shc.tlsConfig = tlsConfig
+	shc.udpMaxSize = udpMaxSize
+	shc.signer = signer
+	shc.batchMaxBytes = batchMaxBytes
+	shc.batchMaxMessages = batchMaxMessages
+	shc.spool = spool
+	shc.connectTimeout = connectTimeout
+	shc.writeTimeout = writeTimeout
+	shc.idleTimeout = idleTimeout
+	shc.dnsRefresh = dnsRefresh
+	shc.srvName = configString(config, "srv-record", "")
+	shc.limiter = limiter
+	shc.http = httpOpts
+	shc.timestamps = timestamps
+	shc.payload = payload
+	shc.fields = fields
+	shc.origin = origin
+	shc.maxMessageSize = maxMessageSize
+	shc.oversizeStrategy = oversizeStrategy
+	if configBool(config, "async", false) {
+		shc.queue, err = newMetricQueue(
+			configInt(config, "queue-size", dfltQueueSize),
+			configString(config, "queue-overflow", dfltQueueOverflow))
+		if err != nil {
+			return nil, err
+		}
+		go shc.runWorker()
+	}
+	return shc, nil
+}
+
+// hekaAddress builds the Heka address (e.g. tcp://host:port) from the
+// protocol, host and port or socket-path options of the task config
+func hekaAddress(config map[string]ctypes.ConfigValue, useTLS bool) (string, error) {
+	protocol := configString(config, "protocol", "tcp")
+	if protocol != "tcp" && protocol != "udp" && protocol != "http" {
+		return "", fmt.Errorf("Unknown protocol '%s' (should be tcp, udp or http)", protocol)
+	}
+	if useTLS && protocol == "udp" {
+		return "", fmt.Errorf("use-tls is only supported with protocol tcp or http")
+	}
+
+	// Unix domain socket, stream for tcp and datagram for udp
+	if socketPath := configString(config, "socket-path", ""); len(socketPath) > 0 {
+		if useTLS {
+			return "", fmt.Errorf("use-tls is not supported with socket-path")
+		}
+		if protocol == "http" {
+			return "", fmt.Errorf("protocol http is not supported with socket-path")
+		}
+		if protocol == "udp" {
+			return fmt.Sprintf("unixgram://%s", socketPath), nil
+		}
+		return fmt.Sprintf("unix://%s", socketPath), nil
+	}
+
+	scheme := protocol
+	if useTLS {
+		scheme = map[string]string{"tcp": "tls", "http": "https"}[protocol]
+	}
+	host := configString(config, "host", "")
+	port := configInt(config, "port", 0)
+
+	// Heka endpoints discovered with DNS
+	if srvName := configString(config, "srv-record", ""); len(srvName) > 0 {
+		if len(host) > 0 || len(configString(config, "endpoints", "")) > 0 {
+			return "", fmt.Errorf("srv-record can not be set together with host or endpoints")
+		}
+		endpoints, err := discoverSRV(srvName, scheme)
+		if err != nil {
+			return "", err
+		}
+		return strings.Join(endpoints, ","), nil
+	}
+
+	// Several Heka endpoints
+	if endpoints := configString(config, "endpoints", ""); len(endpoints) > 0 {
+		if len(host) > 0 {
+			return "", fmt.Errorf("host and endpoints can not be set together")
+		}
+		var addrs []string
+		for _, ep := range strings.Split(endpoints, ",") {
+			e, err := parseEndpoint(ep, scheme, 0)
+			if err != nil {
+				return "", err
+			}
+			if e, err = withTLS(e, useTLS); err != nil {
+				return "", err
+			}
+			addrs = append(addrs, e.String())
+		}
+		return strings.Join(addrs, ","), nil
+	}
+
+	if len(host) == 0 {
+		return "", fmt.Errorf("host and port are required when neither socket-path nor endpoints are set")
+	}
+	// host may also be a host:port string or a full URL
+	e, err := parseEndpoint(host, scheme, port)
+	if err != nil {
+		return "", err
+	}
+	if _, p, err := net.SplitHostPort(e.addr); err == nil && port != 0 && p != strconv.Itoa(port) {
+		return "", fmt.Errorf("host '%s' has port %s, which does not match port %d", host, p, port)
+	}
+	if e, err = withTLS(e, useTLS); err != nil {
+		return "", err
+	}
+	return e.String(), nil
+}
+
+// withTLS checks that an endpoint can be used with the use-tls option,
+// and switches tcp and http endpoints to tls and https when it is set
+func withTLS(e endpoint, useTLS bool) (endpoint, error) {
+	if !useTLS {
+		return e, nil
+	}
+	switch e.scheme {
+	case "tcp":
+		e.scheme = "tls"
+	case "http":
+		e.scheme = "https"
+	case "tls", "https":
+	default:
+		return e, fmt.Errorf("use-tls is not supported with Heka endpoint %s", e)
+	}
+	return e, nil
 }
 
 func handleErr(e error) {
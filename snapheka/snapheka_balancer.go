@@ -0,0 +1,179 @@
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2016 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package snapheka
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// Endpoint selection strategies
+	strategyFailover   = "failover"
+	strategyRoundRobin = "round-robin"
+	strategyHash       = "hash"
+
+	dfltEndpointStrategy = strategyFailover
+	dfltEndpointCooldown = 30 * time.Second
+
+	// Number of points of each endpoint on the consistent hashing ring
+	ringReplicas = 64
+)
+
+// ringPoint is a point of the consistent hashing ring
+type ringPoint struct {
+	hash     uint32
+	endpoint int
+}
+
+// balancer chooses which of several Heka endpoints a message goes to.
+// Endpoints failing to receive a message are ejected for a cool-down
+// period, during which they are only used when no other is available.
+type balancer struct {
+	mutex     sync.Mutex
+	strategy  string
+	endpoints []string
+	cooldown  time.Duration
+	ejected   map[int]time.Time
+	next      int
+	ring      []ringPoint
+}
+
+func newBalancer(strategy string, endpoints []string, cooldown time.Duration) (*balancer, error) {
+	switch strategy {
+	case strategyFailover, strategyRoundRobin, strategyHash:
+	default:
+		return nil, fmt.Errorf("unknown endpoint-strategy '%s' (should be one of %s %s %s)",
+			strategy, strategyFailover, strategyRoundRobin, strategyHash)
+	}
+	b := &balancer{
+		strategy:  strategy,
+		endpoints: endpoints,
+		cooldown:  cooldown,
+		ejected:   make(map[int]time.Time),
+	}
+	if strategy == strategyHash {
+		for i, ep := range endpoints {
+			for r := 0; r < ringReplicas; r++ {
+				b.ring = append(b.ring, ringPoint{hashKey(fmt.Sprintf("%s#%d", ep, r)), i})
+			}
+		}
+		sort.Sort(byHash(b.ring))
+	}
+	return b, nil
+}
+
+func hashKey(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
+
+type byHash []ringPoint
+
+func (r byHash) Len() int           { return len(r) }
+func (r byHash) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r byHash) Less(i, j int) bool { return r[i].hash < r[j].hash }
+
+// pick returns the indexes of the endpoints to try for a message, in
+// order of preference. key is the metric name, used by the hash strategy.
+// Healthy endpoints come first, ejected ones are kept as a last resort.
+func (b *balancer) pick(key string) []int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	var order []int
+	switch b.strategy {
+	case strategyRoundRobin:
+		for i := range b.endpoints {
+			order = append(order, (b.next+i)%len(b.endpoints))
+		}
+		b.next = (b.next + 1) % len(b.endpoints)
+	case strategyHash:
+		order = b.ringOrder(hashKey(key))
+	default:
+		for i := range b.endpoints {
+			order = append(order, i)
+		}
+	}
+
+	now := time.Now()
+	healthy := make([]int, 0, len(order))
+	var ejected []int
+	for _, i := range order {
+		if until, ok := b.ejected[i]; ok && now.Before(until) {
+			ejected = append(ejected, i)
+			continue
+		}
+		healthy = append(healthy, i)
+	}
+	return append(healthy, ejected...)
+}
+
+// perMessage tells whether the endpoint depends on the message. Otherwise
+// a batch of messages can go to the endpoint picked for the first one, so
+// round-robin rotates once per batch.
+func (b *balancer) perMessage() bool {
+	return b.strategy == strategyHash
+}
+
+// ringOrder walks the ring clockwise from h and returns every endpoint
+// once, in the order they are met
+func (b *balancer) ringOrder(h uint32) []int {
+	start := sort.Search(len(b.ring), func(i int) bool { return b.ring[i].hash >= h })
+	seen := make(map[int]bool)
+	order := make([]int, 0, len(b.endpoints))
+	for i := 0; i < len(b.ring) && len(order) < len(b.endpoints); i++ {
+		p := b.ring[(start+i)%len(b.ring)]
+		if !seen[p.endpoint] {
+			seen[p.endpoint] = true
+			order = append(order, p.endpoint)
+		}
+	}
+	return order
+}
+
+// eject marks an endpoint as unhealthy until the cool-down expires
+func (b *balancer) eject(i int) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if _, ok := b.ejected[i]; !ok && len(b.endpoints) > 1 {
+		logger.WithField("_block", "balancer").Warning(
+			fmt.Sprintf("Ejecting Heka endpoint %s for %v",
+				b.endpoints[i], b.cooldown))
+	}
+	b.ejected[i] = time.Now().Add(b.cooldown)
+}
+
+// restore marks an endpoint as healthy again
+func (b *balancer) restore(i int) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if _, ok := b.ejected[i]; ok {
+		logger.WithField("_block", "balancer").Info(
+			fmt.Sprintf("Heka endpoint %s is back", b.endpoints[i]))
+		delete(b.ejected, i)
+	}
+}
@@ -0,0 +1,161 @@
+//
+// +build unit
+
+package snapheka
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/intelsdi-x/snap/control/plugin"
+	"github.com/intelsdi-x/snap/core"
+	"github.com/intelsdi-x/snap/core/ctypes"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestBalancer(t *testing.T) {
+	endpoints := []string{"heka1:5565", "heka2:5565", "heka3:5565"}
+
+	Convey("Unknown strategies should be rejected", t, func() {
+		_, err := newBalancer("random", endpoints, time.Second)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Failover should prefer the first healthy endpoint", t, func() {
+		b, err := newBalancer(strategyFailover, endpoints, time.Hour)
+		So(err, ShouldBeNil)
+		So(b.pick("foo"), ShouldResemble, []int{0, 1, 2})
+		b.eject(0)
+		So(b.pick("foo"), ShouldResemble, []int{1, 2, 0})
+		b.restore(0)
+		So(b.pick("foo"), ShouldResemble, []int{0, 1, 2})
+	})
+
+	Convey("Ejected endpoints should be retried after the cool-down", t, func() {
+		b, err := newBalancer(strategyFailover, endpoints, 10*time.Millisecond)
+		So(err, ShouldBeNil)
+		b.eject(0)
+		So(b.pick("foo")[0], ShouldEqual, 1)
+		time.Sleep(20 * time.Millisecond)
+		So(b.pick("foo")[0], ShouldEqual, 0)
+	})
+
+	Convey("Round-robin should rotate over the endpoints", t, func() {
+		b, err := newBalancer(strategyRoundRobin, endpoints, time.Hour)
+		So(err, ShouldBeNil)
+		So(b.pick("foo")[0], ShouldEqual, 0)
+		So(b.pick("foo")[0], ShouldEqual, 1)
+		So(b.pick("foo")[0], ShouldEqual, 2)
+		So(b.pick("foo")[0], ShouldEqual, 0)
+		b.eject(1)
+		So(b.pick("foo")[0], ShouldEqual, 2)
+	})
+
+	Convey("Hash should always send a metric to the same endpoint", t, func() {
+		b, err := newBalancer(strategyHash, endpoints, time.Hour)
+		So(err, ShouldBeNil)
+		used := make(map[int]bool)
+		for i := 0; i < 100; i++ {
+			name := fmt.Sprintf("intel.mock.metric%d", i)
+			order := b.pick(name)
+			So(len(order), ShouldEqual, len(endpoints))
+			So(b.pick(name), ShouldResemble, order)
+			used[order[0]] = true
+		}
+		So(len(used), ShouldEqual, len(endpoints))
+
+		Convey("and only move the metrics of an ejected endpoint", func() {
+			before := make(map[string]int)
+			for i := 0; i < 100; i++ {
+				name := fmt.Sprintf("intel.mock.metric%d", i)
+				before[name] = b.pick(name)[0]
+			}
+			b.eject(2)
+			for name, ep := range before {
+				if ep != 2 {
+					So(b.pick(name)[0], ShouldEqual, ep)
+				} else {
+					So(b.pick(name)[0], ShouldNotEqual, 2)
+				}
+			}
+		})
+	})
+}
+
+func TestHekaFailover(t *testing.T) {
+	defer hekaConns.closeAll()
+
+	Convey("Send metrics to a pair of Heka endpoints", t, func() {
+		standby, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		defer standby.Close()
+		accepted := acceptAll(standby)
+		primary, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		primaryAddr := primary.Addr().String()
+		primary.Close()
+
+		config := map[string]ctypes.ConfigValue{
+			"endpoints":          ctypes.ConfigValueStr{Value: primaryAddr + "," + standby.Addr().String()},
+			"endpoint-strategy":  ctypes.ConfigValueStr{Value: "failover"},
+			"retry-max-attempts": ctypes.ConfigValueInt{Value: 1},
+		}
+		shc, err := newClientFromConfig(config)
+		So(err, ShouldBeNil)
+		So(len(shc.hekaHosts), ShouldEqual, 2)
+		metrics := []plugin.MetricType{
+			*plugin.NewMetricType(core.NewNamespace("intel", "mock", "foo"), time.Now(), nil, "", 1),
+		}
+
+		Convey("Messages should fail over to the standby endpoint", func() {
+			So(shc.sendToHeka(metrics), ShouldBeNil)
+			So(<-accepted, ShouldNotBeNil)
+			So(shc.balancer.pick("intel.mock.foo"), ShouldResemble, []int{1, 0})
+		})
+	})
+
+	Convey("Round-robin should rotate once per batch", t, func() {
+		var addrs []string
+		for i := 0; i < 2; i++ {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			So(err, ShouldBeNil)
+			defer l.Close()
+			acceptAll(l)
+			addrs = append(addrs, l.Addr().String())
+		}
+		config := map[string]ctypes.ConfigValue{
+			"endpoints":         ctypes.ConfigValueStr{Value: strings.Join(addrs, ",")},
+			"endpoint-strategy": ctypes.ConfigValueStr{Value: strategyRoundRobin},
+		}
+		shc, err := newClientFromConfig(config)
+		So(err, ShouldBeNil)
+		So(shc.sendToHeka(mockMetrics(4)), ShouldBeNil)
+		So(shc.balancer.pick("")[0], ShouldEqual, 1)
+
+		Convey("and once per message without batching", func() {
+			shc.batchMaxMessages = 1
+			So(shc.sendToHeka(mockMetrics(3)), ShouldBeNil)
+			So(shc.balancer.pick("")[0], ShouldEqual, 1)
+		})
+	})
+
+	Convey("Endpoints should be validated", t, func() {
+		config := map[string]ctypes.ConfigValue{
+			"endpoints": ctypes.ConfigValueStr{Value: "heka1:5565,heka2"},
+		}
+		_, err := newClientFromConfig(config)
+		So(err, ShouldNotBeNil)
+		config["endpoints"] = ctypes.ConfigValueStr{Value: "heka1:5565,heka2:5565"}
+		config["host"] = ctypes.ConfigValueStr{Value: "heka3"}
+		_, err = newClientFromConfig(config)
+		So(err, ShouldNotBeNil)
+		delete(config, "host")
+		config["endpoint-strategy"] = ctypes.ConfigValueStr{Value: "random"}
+		_, err = newClientFromConfig(config)
+		So(err, ShouldNotBeNil)
+	})
+}
@@ -0,0 +1,138 @@
+//
+// +build unit
+
+package snapheka
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/intelsdi-x/snap/control/plugin"
+	"github.com/intelsdi-x/snap/core"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func mockMetrics(n int) []plugin.MetricType {
+	metrics := make([]plugin.MetricType, 0, n)
+	for i := 0; i < n; i++ {
+		metrics = append(metrics, *plugin.NewMetricType(
+			core.NewNamespace("intel", "mock", fmt.Sprintf("metric%d", i)), time.Now(), nil, "", i))
+	}
+	return metrics
+}
+
+// dynamicMetric creates a metric named intel.mock.<element>.load with its
+// dynamic element set to value, collected at a fixed time
+func dynamicMetric(element, value string, tags map[string]string, data interface{}) plugin.MetricType {
+	ns := core.NewNamespace("intel", "mock").AddDynamicElement(element, "").AddStaticElement("load")
+	ns[2].Value = value
+	return *plugin.NewMetricType(ns, time.Unix(1500000000, 0), tags, "", data)
+}
+
+// countFrames decodes consecutive framed messages and returns their number
+func countFrames(b []byte) (int, error) {
+	n := 0
+	for len(b) > 0 {
+		header, _, err := decodeFrame(b)
+		if err != nil {
+			return n, err
+		}
+		b = b[3+int(b[1])+int(header.GetMessageLength()):]
+		n++
+	}
+	return n, nil
+}
+
+// countingConn records the number of writes made to a connection
+type countingConn struct {
+	net.Conn
+	writes int
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	c.writes++
+	return c.Conn.Write(b)
+}
+
+func TestHekaBatch(t *testing.T) {
+	defer hekaConns.closeAll()
+
+	Convey("Send metrics in batches", t, func() {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		defer l.Close()
+		received := readAll(l)
+		shc, err := NewSnapHekaClient("tcp://"+l.Addr().String(), "")
+		So(err, ShouldBeNil)
+		conn, err := net.Dial("tcp", l.Addr().String())
+		So(err, ShouldBeNil)
+		counter := &countingConn{Conn: conn}
+		_, err = hekaConns.get(shc.id, "tcp", l.Addr().String(), 0, func() (net.Conn, error) { return counter, nil })
+		So(err, ShouldBeNil)
+
+		Convey("Batches should be bounded by the message count", func() {
+			shc.batchMaxMessages = 4
+			So(shc.sendToHeka(mockMetrics(10)), ShouldBeNil)
+			So(counter.writes, ShouldEqual, 3)
+			hekaConns.closeAll()
+			n, err := countFrames(<-received)
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 10)
+		})
+		Convey("Batches should be bounded by the byte size", func() {
+			shc.batchMaxBytes = 1
+			So(shc.sendToHeka(mockMetrics(10)), ShouldBeNil)
+			So(counter.writes, ShouldEqual, 10)
+			hekaConns.closeAll()
+			n, err := countFrames(<-received)
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 10)
+		})
+	})
+}
+
+func benchmarkSendToHeka(b *testing.B, batchMaxMessages int) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(ioutil.Discard, c)
+		}
+	}()
+	defer hekaConns.closeAll()
+	shc, err := NewSnapHekaClient("tcp://"+l.Addr().String(), "")
+	if err != nil {
+		b.Fatal(err)
+	}
+	shc.batchMaxMessages = batchMaxMessages
+	metrics := mockMetrics(1000)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := shc.sendToHeka(metrics); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkSendToHekaPerMessage writes every message on its own
+func BenchmarkSendToHekaPerMessage(b *testing.B) {
+	benchmarkSendToHeka(b, 1)
+}
+
+// BenchmarkSendToHekaBatched writes messages in batches with the defaults
+func BenchmarkSendToHekaBatched(b *testing.B) {
+	benchmarkSendToHeka(b, SnapDfltBatchMaxMessages)
+}
@@ -1,14 +1,17 @@
 package snapheka
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"net/url"
+	"net"
+	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -25,6 +28,11 @@ const (
 	SnapDfltHekaSeverity  = 6
 	SnapDfltHekaMsgType   = "snap.heka"
 	SnapDfltHekaMsgLogger = "snap.heka.logger"
+	// Largest UDP payload over IPv4 (65535 - 8 byte UDP header - 20 byte IP header)
+	SnapDfltUDPMaxSize = 65507
+	// Limits of the messages written to a stream connection at once
+	SnapDfltBatchMaxBytes    = 64 * 1024
+	SnapDfltBatchMaxMessages = 500
 )
 
 var (
@@ -33,13 +41,63 @@ var (
 	SnapHekaMsgType                     = SnapDfltHekaMsgType
 	SnapHekaMsgLogger                   = SnapDfltHekaMsgLogger
 	MetricMappings    map[string]string = make(map[string]string)
+	// Last id given to a SnapHekaClient
+	clientIDs uint64
 )
 
 // SnapHekaClient defines the Heka connection scheme (e.g. tcp)
-// and the connection address.
+// and the connection addresses.
 type SnapHekaClient struct {
+	// id of the client, owning its connections to Heka
+	id         uint64
 	hekaScheme string
-	hekaHost   string
+	hekaHosts  []string
+	balancer   *balancer
+	retry      retryPolicy
+	tlsConfig  *tls.Config
+	udpMaxSize int
+	signer     *message.MessageSigningConfig
+	// Batching of framed messages into one write
+	batchMaxBytes    int
+	batchMaxMessages int
+	batchBuf         []byte
+	// Queue of the metrics sent by a background worker in async mode
+	queue *metricQueue
+	// Spool of the messages which could not be sent, nil when disabled
+	spool *spool
+	// Deadlines of the connection to Heka, zero means no deadline
+	connectTimeout time.Duration
+	writeTimeout   time.Duration
+	idleTimeout    time.Duration
+	// DNS re-resolution of the endpoints, and SRV record listing them
+	dnsRefresh time.Duration
+	srvName    string
+	resolvedAt time.Time
+	// Limits of the messages and bytes sent per second, nil when unlimited
+	limiter *rateLimiter
+	// Largest message accepted by hekad and what to do with larger ones
+	maxMessageSize   int
+	oversizeStrategy string
+	// Source of the message Timestamp and handling of invalid ones
+	timestamps timestampPolicy
+	// Format of the message Payload
+	payload payloadFormatter
+	// Conversion of the metric data into message fields
+	fields fieldOptions
+	// Sources of the message Hostname and Pid
+	origin originPolicy
+	// Settings and client of the http and https transports, and time of
+	// the last POST used to close idle connections
+	http         httpOptions
+	httpClient   *http.Client
+	httpLastPost time.Time
+}
+
+// hekaFrame is an encoded Heka message ready to be sent
+type hekaFrame struct {
+	// metric name, used to choose the endpoint with the hash strategy
+	key string
+	buf []byte
 }
 
 type mappings struct {
@@ -124,69 +182,322 @@ func HandleMappingsFile(mfile string) {
 			SnapHekaSeverity, SnapHekaMsgType, SnapHekaMsgLogger))
 }
 
-// NewSnapHekaClient creates a new instance of Heka client
+// NewSnapHekaClient creates a new instance of Heka client.
+// addr is one Heka URL (e.g. tcp://localhost:5565) or a comma separated
+// list of URLs with the same scheme, used with the failover strategy.
 func NewSnapHekaClient(addr string, mfile string) (shc *SnapHekaClient, err error) {
 	logger.WithField("_block", "NewSnapHekaClient").Debug("Enter NewSnapHekaClient")
 
-	shc = &SnapHekaClient{}
+	shc = &SnapHekaClient{
+		id:               atomic.AddUint64(&clientIDs, 1),
+		retry:            newRetryPolicy(),
+		connectTimeout:   dfltConnectTimeout,
+		writeTimeout:     dfltWriteTimeout,
+		udpMaxSize:       SnapDfltUDPMaxSize,
+		batchMaxBytes:    SnapDfltBatchMaxBytes,
+		batchMaxMessages: SnapDfltBatchMaxMessages,
+		resolvedAt:       time.Now(),
+		maxMessageSize:   SnapDfltMaxMessageSize,
+		oversizeStrategy: dfltOversizeStrategy,
+		http:             newHTTPOptions(),
+		timestamps:       newTimestampPolicy(),
+		payload:          newPayloadFormatter(),
+		fields:           newFieldOptions(),
+		origin:           newOriginPolicy(),
+	}
 
-	hekaURL, err := url.ParseRequestURI(addr)
+	for _, a := range strings.Split(addr, ",") {
+		e, err := parseEndpoint(a, "tcp", 0)
+		if err != nil {
+			return nil, err
+		}
+		if len(shc.hekaScheme) > 0 && e.scheme != shc.hekaScheme {
+			return nil, fmt.Errorf("all Heka endpoints must use the same scheme, got %s and %s",
+				shc.hekaScheme, e.scheme)
+		}
+		shc.hekaScheme = e.scheme
+		// Unix domain sockets are addressed by path (e.g. unix:///var/run/heka.sock)
+		shc.hekaHosts = append(shc.hekaHosts, e.addr)
+	}
+	shc.balancer, err = newBalancer(dfltEndpointStrategy, shc.hekaHosts, dfltEndpointCooldown)
 	if err != nil {
 		return nil, err
 	}
-
-	shc.hekaScheme = hekaURL.Scheme
-	shc.hekaHost = hekaURL.Host
 	HandleMappingsFile(mfile)
 	return shc, nil
 }
 
+// publish sends metrics to Heka, or queues them for the background
+// worker when the client is asynchronous
+func (shc *SnapHekaClient) publish(metrics []plugin.MetricType) error {
+	if shc.queue != nil {
+		shc.publishAsync(metrics)
+		return nil
+	}
+	return shc.sendToHeka(metrics)
+}
+
+// close stops the background worker of the client once the queued
+// metrics are sent, and closes the connections of the client
+func (shc *SnapHekaClient) close() {
+	if shc.queue != nil {
+		// the worker closes the connections once the queue is drained
+		shc.queue.close()
+		return
+	}
+	shc.release()
+}
+
+// release closes the connections and the spool segment held by the client
+func (shc *SnapHekaClient) release() {
+	hekaConns.closeOwner(shc.id)
+	shc.closeHTTP()
+	if shc.spool != nil {
+		shc.spool.close()
+	}
+}
+
 // sendToHeka sends array of snap metrics to Heka
 func (shc *SnapHekaClient) sendToHeka(metrics []plugin.MetricType) error {
+	shc.refreshDNS()
 	pid := int32(os.Getpid())
 	hostname, _ := os.Hostname()
 
-	// Initializes Heka message encoder
-	encoder := client.NewProtobufEncoder(nil)
-
-	// Creates Heka message sender
-	sender, err := client.NewNetworkSender(shc.hekaScheme, shc.hekaHost)
-	if err != nil {
-		logger.WithField("_block", "sendToHeka").Error("create NewNetworkSender error: ", err)
-		return err
-	}
+	// Initializes Heka message encoder, signing messages when configured
+	encoder := client.NewProtobufEncoder(shc.signer)
 
-	var buf []byte
+	frames := make([]hekaFrame, 0, len(metrics))
+	var rejected []error
 	for _, m := range metrics {
-		b, _, e := plugin.MarshalMetricTypes(plugin.SnapJSONContentType, []plugin.MetricType{m})
-		if e != nil {
-			logger.WithField("_block", "sendToHeka").Error("marshal metric error: ", m)
+		pl, err := shc.payload.payload(m, shc.fields)
+		if err != nil {
+			logger.WithField("_block", "sendToHeka").Error(err)
+			rejected = append(rejected, err)
 			continue
 		}
 
 		// Converts snap metric to Heka message
-		msg, err := createHekaMessage(string(b), m, pid, hostname)
+		msg, err := createHekaMessage(pl, m, shc.origin.pidOf(m, pid), shc.origin.hostnameOf(m, hostname), shc.fields)
 		if err != nil {
 			logger.WithField("_block", "sendToHeka").Error("create message error: ", err)
+			rejected = append(rejected, err)
+			continue
+		}
+		if err = shc.timestamps.apply(msg, m, shc.fields); err != nil {
+			logger.WithField("_block", "sendToHeka").Error(err)
+			rejected = append(rejected, err)
+			continue
+		}
+		if err = shc.limitMessageSize(msg, m); err != nil {
+			logger.WithField("_block", "sendToHeka").Error(err)
+			rejected = append(rejected, err)
 			continue
 		}
+		var buf []byte
 		err = encoder.EncodeMessageStream(msg, &buf)
 		if err != nil {
 			logger.WithField("_block", "sendToHeka").Error("encoding error: ", err)
+			rejected = append(rejected, err)
+			continue
+		}
+		if err = shc.checkFrameSize(buf, m); err != nil {
+			logger.WithField("_block", "sendToHeka").Error(err)
+			rejected = append(rejected, err)
 			continue
 		}
+		if shc.isHTTP() && shc.http.format == httpFormatJSON {
+			if buf, err = encodeJSON(msg); err != nil {
+				logger.WithField("_block", "sendToHeka").Error("encoding error: ", err)
+				rejected = append(rejected, err)
+				continue
+			}
+		}
+		frames = append(frames, hekaFrame{key: namespaceString(m), buf: buf})
+	}
+	frames = shc.throttle(frames)
 
-		err = sender.SendMessage(buf)
-		if err != nil {
-			logger.WithField("_block", "sendToHeka").Error("sending message error: ", err)
+	// Messages spooled during an outage are sent first to keep the order
+	if shc.spool != nil && !shc.spool.empty() {
+		if err := shc.replaySpool(); err != nil {
+			if err = shc.spoolFrames(frames, err); err != nil {
+				return err
+			}
+			return shc.rejectedError(rejected, len(metrics))
+		}
+	}
+
+	// Sends the messages, retrying the ones which failed unless the
+	// failure is permanent
+	pending, err := shc.sendFrames(frames)
+	attempts := 1
+	for ; len(pending) > 0 && attempts < shc.retry.maxAttempts && !isPermanent(err); attempts++ {
+		delay := shc.retry.delay(attempts)
+		logger.WithField("_block", "sendToHeka").Warning(
+			fmt.Sprintf("sending message error: %v, retrying %d messages in %v (retry %d of %d)",
+				err, len(pending), delay, attempts, shc.retry.maxAttempts-1))
+		time.Sleep(delay)
+		pending, err = shc.sendFrames(pending)
+	}
+	if len(pending) > 0 && shc.spool != nil && !isPermanent(err) {
+		if err = shc.spoolFrames(pending, err); err != nil {
+			return err
+		}
+		pending = nil
+	}
+	if len(pending) > 0 {
+		logger.WithField("_block", "sendToHeka").Error("sending message error: ", err)
+		return &SendError{
+			Pending:  len(pending),
+			Total:    len(frames),
+			Addr:     fmt.Sprintf("%s://%s", shc.hekaScheme, strings.Join(shc.hekaHosts, ",")),
+			Attempts: attempts,
+			Err:      err,
+		}
+	}
+	return shc.rejectedError(rejected, len(metrics))
+}
+
+// rejectedError reports the messages which were not sent because they are
+// invalid for the transport
+func (shc *SnapHekaClient) rejectedError(rejected []error, total int) error {
+	if len(rejected) > 0 {
+		return fmt.Errorf("%d of %d messages were rejected, first error: %v",
+			len(rejected), total, rejected[0])
+	}
+	return nil
+}
+
+// isUnixSocket tells whether the client sends to a unix domain socket
+func (shc *SnapHekaClient) isUnixSocket() bool {
+	return shc.hekaScheme == "unix" || shc.hekaScheme == "unixgram"
+}
+
+// isDatagram tells whether the client sends one message per datagram
+func (shc *SnapHekaClient) isDatagram() bool {
+	return shc.hekaScheme == "udp" || shc.hekaScheme == "unixgram"
+}
+
+// checkFrameSize verifies that a framed message can be sent in one piece
+// with the client transport. Heka UdpInput expects one whole message per
+// datagram, so messages larger than a datagram cannot be sent over UDP
+// or unixgram.
+func (shc *SnapHekaClient) checkFrameSize(buf []byte, m plugin.MetricType) error {
+	if shc.isDatagram() && len(buf) > shc.udpMaxSize {
+		return fmt.Errorf("message for metric %s is %d bytes and does not fit in a %s datagram (udp-max-size is %d bytes)",
+			namespaceString(m), len(buf), shc.hekaScheme, shc.udpMaxSize)
+	}
+	return nil
+}
+
+// sendFrames sends framed Heka messages in order. Consecutive messages going
+// to the same endpoint are copied into a reusable buffer and written at once,
+// up to batchMaxBytes or batchMaxMessages, and to the rate limits in delay
+// mode. It stops at the first failure and returns the messages which were
+// not sent along with the error.
+func (shc *SnapHekaClient) sendFrames(frames []hekaFrame) ([]hekaFrame, error) {
+	maxMessages, maxBytes := shc.batchMaxMessages, shc.batchMaxBytes
+	if shc.isDatagram() || maxMessages < 1 {
+		// Heka expects exactly one message per datagram
+		maxMessages = 1
+	}
+	if shc.limiter != nil && shc.limiter.mode == throttleDelay {
+		maxMessages, maxBytes = shc.limiter.batchLimits(maxMessages, maxBytes)
+	}
+	for i := 0; i < len(frames); {
+		order := shc.balancer.pick(frames[i].key)
+		batch := append(shc.batchBuf[:0], frames[i].buf...)
+		j := i + 1
+		for ; j < len(frames) && j-i < maxMessages; j++ {
+			if len(batch)+len(frames[j].buf) > maxBytes {
+				break
+			}
+			if shc.balancer.perMessage() && shc.balancer.pick(frames[j].key)[0] != order[0] {
+				break
+			}
+			batch = append(batch, frames[j].buf...)
+		}
+		shc.batchBuf = batch
+		if shc.limiter != nil && shc.limiter.mode == throttleDelay {
+			shc.limiter.wait(j-i, len(batch))
+		}
+		if err := shc.sendBuffer(order, batch); err != nil {
+			return frames[i:], err
+		}
+		i = j
+	}
+	return nil, nil
+}
+
+// sendBuffer writes framed Heka messages to the endpoints in order,
+// failing over to the next one until a write succeeds
+func (shc *SnapHekaClient) sendBuffer(order []int, buf []byte) error {
+	var err error
+	for _, i := range order {
+		if err = shc.sendMessage(shc.hekaHosts[i], buf); err == nil {
+			shc.balancer.restore(i)
+			return nil
 		}
+		logger.WithField("_block", "sendBuffer").Warning(
+			fmt.Sprintf("sending to %s://%s failed: %v",
+				shc.hekaScheme, shc.hekaHosts[i], err))
+		if isPermanent(err) {
+			// the endpoint is up but refuses the messages
+			return err
+		}
+		shc.balancer.eject(i)
+	}
+	return err
+}
+
+// sendMessage writes a framed Heka message over the persistent connection
+// to host. When the write fails (e.g. broken pipe) the connection is dropped
+// so that the next attempt dials again.
+func (shc *SnapHekaClient) sendMessage(host string, buf []byte) error {
+	if shc.isHTTP() {
+		return shc.postHTTP(host, buf)
+	}
+	sender, err := hekaConns.get(shc.id, shc.hekaScheme, host, shc.idleTimeout, shc.dialer(host))
+	if err != nil {
+		return err
+	}
+	if err = sender.sendWithTimeout(buf, shc.writeTimeout); err != nil {
+		hekaConns.drop(sender)
+		return err
 	}
-	sender.Close()
 	return nil
 }
 
+// dialer returns the function opening a new connection to a Heka host.
+// The tls scheme is TCP with TLS on top, as expected by a Heka TcpInput
+// with use_tls enabled. The connect timeout includes the TLS handshake.
+func (shc *SnapHekaClient) dialer(host string) dialFunc {
+	return func() (net.Conn, error) {
+		d := &net.Dialer{Timeout: shc.connectTimeout}
+		var conn net.Conn
+		var err error
+		if shc.hekaScheme == "tls" {
+			tlsConfig := shc.tlsConfig
+			if tlsConfig == nil {
+				tlsConfig = &tls.Config{}
+			}
+			conn, err = tls.DialWithDialer(d, "tcp", host, tlsConfig)
+		} else {
+			conn, err = d.Dial(shc.hekaScheme, host)
+		}
+		if isTimeout(err) {
+			return nil, &TimeoutError{Op: "connect", Addr: connKey(shc.hekaScheme, host), Duration: shc.connectTimeout}
+		}
+		return conn, err
+	}
+}
+
+// namespaceString returns the full metric namespace joined with dots
+func namespaceString(m plugin.MetricType) string {
+	return strings.Join(m.Namespace().Strings(), ".")
+}
+
 // createHekaMessage converts a Snap metric into an Heka message
-func createHekaMessage(pl string, m plugin.MetricType, pid int32, hostname string) (*message.Message, error) {
+func createHekaMessage(pl string, m plugin.MetricType, pid int32, hostname string, opts fieldOptions) (*message.Message, error) {
 	msg := &message.Message{}
 	msg.SetUuid(uuid.NewRandom())
 	msg.SetTimestamp(time.Now().UnixNano())
@@ -197,9 +508,9 @@ func createHekaMessage(pl string, m plugin.MetricType, pid int32, hostname strin
 	msg.SetPid(pid)
 	msg.SetHostname(hostname)
 
-	err := setHekaMessageFields(m, msg)
+	err := setHekaMessageFields(m, msg, opts)
 	if err != nil {
-		errStr := fmt.Sprintf("Can not extract metric name, tags or dimensions")
+		errStr := fmt.Sprintf("Can not extract metric name, tags or dimensions: %v", err)
 		log.Error(errStr)
 		return nil, errors.New(errStr)
 	}
@@ -224,10 +535,9 @@ func addToDimensions(f *message.Field, fName string) (*message.Field, error) {
 }
 
 // function which fills all part of Heka message
-func setHekaMessageFields(m plugin.MetricType, msg *message.Message) error {
+func setHekaMessageFields(m plugin.MetricType, msg *message.Message, opts fieldOptions) error {
 	mName := make([]string, 0, len(m.Namespace()))
 	var dimField *message.Field
-	var err error
 	// Loop on namespace elements
 	for _, elt := range m.Namespace() {
 		logger.WithField("_block", "setHekaMessageFields").Debug(
@@ -235,33 +545,46 @@ func setHekaMessageFields(m plugin.MetricType, msg *message.Message) error {
 				elt))
 		// Dynamic element is not inserted in metric name
 		// but rather added to dimension field
-		if elt.IsDynamic() {
-			dimField, err = addToDimensions(dimField, elt.Name)
-			if err != nil {
-				logger.WithField("_block", "setHekaMessageFields").Error(err)
-				return err
-			}
-			addField(elt.Name, elt.Value, msg)
-		} else {
+		if !elt.IsDynamic() {
 			// Static element is concatenated to metric name
 			mName = append(mName, elt.Value)
 		}
 	}
-	// Processing of tags
-	if len(m.Tags()) > 0 {
-		for tag, value := range m.Tags() {
+	// Processing of dynamic elements and tags
+	dims, err := opts.dimensionFields(m)
+	if err != nil {
+		logger.WithField("_block", "setHekaMessageFields").Error(err)
+		return err
+	}
+	for _, d := range dims {
+		logger.WithField("_block", "setHekaMessageFields").Debug(
+			fmt.Sprintf("Adding dimension=%s value=%s",
+				d.field, d.value))
+		dimField, err = addToDimensions(dimField, d.field)
+		if err != nil {
+			logger.WithField("_block", "setHekaMessageFields").Error(err)
+			return err
+		}
+		addField(d.field, d.value, msg)
+	}
+	// Static fields of the task, unless the metric has a field of that name
+	for _, sf := range opts.staticFields {
+		if hasDimension(dims, sf.name) {
 			logger.WithField("_block", "setHekaMessageFields").Debug(
-				fmt.Sprintf("Adding tag=%s value=%s",
-					tag, value))
-			dimField, err = addToDimensions(dimField, tag)
+				fmt.Sprintf("Static field %s is a dimension of the metric",
+					sf.name))
+			continue
+		}
+		if opts.staticDimensions {
+			dimField, err = addToDimensions(dimField, sf.name)
 			if err != nil {
 				logger.WithField("_block", "setHekaMessageFields").Error(err)
 				return err
 			}
-			addField(tag, value, msg)
 		}
+		addFieldRepresentation(sf.name, sf.value, sf.representation, msg)
 	}
-	if dimField != nil {
+	if dimField != nil && opts.fieldFilter.allows("dimensions") {
 		msg.AddField(dimField)
 	}
 	// Handle metric name
@@ -313,27 +636,35 @@ func setHekaMessageFields(m plugin.MetricType, msg *message.Message) error {
 			}
 		}
 	}
-	addField("name", metricName, msg)
-	addField("value", getData(m.Data()), msg)
-	addField("timestamp", m.Timestamp().UnixNano(), msg)
+	if opts.fieldFilter.allows("name") {
+		addField("name", metricName, msg)
+	}
+	// The unit of the metric is the representation of its value
+	if err = opts.addValueField("value", m.Data(), m.Unit(), msg); err != nil {
+		logger.WithField("_block", "setHekaMessageFields").Error(err)
+		return err
+	}
+	if opts.fieldFilter.allows("timestamp") {
+		addField("timestamp", m.Timestamp().UnixNano(), msg)
+	}
+	opts.addMetadataFields(m, msg)
 	return nil
 }
 
-// getData converts unit64 to int64 for Heka supported data type
-func getData(v interface{}) interface{} {
-	switch d := v.(type) {
-	case uint64:
-		return int64(d)
-	case uint32:
-		return int32(d)
-	default:
-		return d
-	}
+// addField adds a field to msg, logging the values Heka does not support
+func addField(name string, value interface{}, msg *message.Message) error {
+	return addFieldRepresentation(name, value, "", msg)
 }
 
-func addField(name string, value interface{}, msg *message.Message) {
-	field, err := message.NewField(name, value, "")
-	if err == nil {
-		msg.AddField(field)
+// addFieldRepresentation adds a field with a representation (e.g. the unit
+// of the value) to msg
+func addFieldRepresentation(name string, value interface{}, representation string, msg *message.Message) error {
+	field, err := message.NewField(name, value, representation)
+	if err != nil {
+		err = fmt.Errorf("can not add field %s: %v", name, err)
+		logger.WithField("_block", "addField").Error(err)
+		return err
 	}
+	msg.AddField(field)
+	return nil
 }
@@ -0,0 +1,93 @@
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2016 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package snapheka
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/intelsdi-x/snap/core/ctypes"
+)
+
+// configString returns the string value of key, or dflt when it is not set
+func configString(config map[string]ctypes.ConfigValue, key string, dflt string) string {
+	if v, ok := config[key].(ctypes.ConfigValueStr); ok {
+		return v.Value
+	}
+	return dflt
+}
+
+// configInt returns the integer value of key, or dflt when it is not set
+func configInt(config map[string]ctypes.ConfigValue, key string, dflt int) int {
+	if v, ok := config[key].(ctypes.ConfigValueInt); ok {
+		return v.Value
+	}
+	return dflt
+}
+
+// configBool returns the boolean value of key, or dflt when it is not set
+func configBool(config map[string]ctypes.ConfigValue, key string, dflt bool) bool {
+	if v, ok := config[key].(ctypes.ConfigValueBool); ok {
+		return v.Value
+	}
+	return dflt
+}
+
+// configDuration parses the value of key as a Go duration (e.g. "500ms"),
+// returning dflt when the key is not set or empty
+func configDuration(config map[string]ctypes.ConfigValue, key string, dflt time.Duration) (time.Duration, error) {
+	s := configString(config, key, "")
+	if len(s) == 0 {
+		return dflt, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return dflt, fmt.Errorf("invalid duration for %s: %v", key, err)
+	}
+	if d < 0 {
+		return dflt, fmt.Errorf("invalid duration for %s: %s is negative", key, s)
+	}
+	return d, nil
+}
+
+// configSecret reads a secret from the file named by fileKey, without its
+// trailing newline, or from the environment variable named by envKey, so
+// that it does not appear in the task manifest. set is false when neither
+// key is set.
+func configSecret(config map[string]ctypes.ConfigValue, fileKey, envKey string) (secret string, set bool, err error) {
+	file := configString(config, fileKey, "")
+	env := configString(config, envKey, "")
+	switch {
+	case len(file) > 0 && len(env) > 0:
+		return "", true, fmt.Errorf("%s and %s can not be set together", fileKey, envKey)
+	case len(file) > 0:
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return "", true, fmt.Errorf("reading %s %s: %v", fileKey, file, err)
+		}
+		return strings.TrimRight(string(b), "\r\n"), true, nil
+	case len(env) > 0:
+		return os.Getenv(env), true, nil
+	}
+	return "", false, nil
+}
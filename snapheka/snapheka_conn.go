@@ -0,0 +1,223 @@
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2016 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package snapheka
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// probeTimeout bounds the read used to check a cached connection
+	probeTimeout = time.Millisecond
+	// probeIdle is how long a connection must have been unused before
+	// it is checked again, so that bursts of writes are not slowed down
+	probeIdle = 100 * time.Millisecond
+)
+
+// hekaConns holds the Heka connections of all the clients of the plugin
+// instance. Each client has its own connections, so that a connection
+// dialed with the TLS settings of a task is never used by another one.
+var hekaConns = newConnManager()
+
+// hekaConn is a connection to Heka which is kept open between
+// Publish calls. It satisfies the Heka client.Sender interface.
+type hekaConn struct {
+	// manager holding the connection, whose mutex guards lastUsed
+	cm *connManager
+	// id of the client owning the connection
+	owner    uint64
+	scheme   string
+	host     string
+	conn     net.Conn
+	lastUsed time.Time
+}
+
+// SendMessage writes an already framed Heka message to the connection
+func (hc *hekaConn) SendMessage(outBytes []byte) error {
+	return hc.sendWithTimeout(outBytes, 0)
+}
+
+// sendWithTimeout writes framed Heka messages to the connection, failing
+// with a TimeoutError when the write does not complete within timeout.
+// A zero timeout waits as long as needed.
+func (hc *hekaConn) sendWithTimeout(outBytes []byte, timeout time.Duration) error {
+	now := time.Now()
+	hc.cm.mutex.Lock()
+	hc.lastUsed = now
+	hc.cm.mutex.Unlock()
+	// a deadline left by a previous write must not apply to this one
+	deadline := time.Time{}
+	if timeout > 0 {
+		deadline = now.Add(timeout)
+	}
+	if err := hc.conn.SetWriteDeadline(deadline); err != nil {
+		return err
+	}
+	_, err := hc.conn.Write(outBytes)
+	if isTimeout(err) {
+		return &TimeoutError{Op: "write", Addr: connKey(hc.scheme, hc.host), Duration: timeout}
+	}
+	return err
+}
+
+// Close closes the underlying network connection
+func (hc *hekaConn) Close() {
+	hc.conn.Close()
+}
+
+// isBroken probes the connection with a very short read deadline.
+// Heka inputs never write back to the sender, so anything other than
+// a timeout means that the peer has gone away.
+func (hc *hekaConn) isBroken() bool {
+	if err := hc.conn.SetReadDeadline(time.Now().Add(probeTimeout)); err != nil {
+		return true
+	}
+	defer hc.conn.SetReadDeadline(time.Time{})
+	var b [1]byte
+	_, err := hc.conn.Read(b[:])
+	if err == nil {
+		return false
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return false
+	}
+	logger.WithField("_block", "isBroken").Debug(
+		fmt.Sprintf("Connection to %s://%s is broken: %v",
+			hc.scheme, hc.host, err))
+	return true
+}
+
+// connManager keeps Heka connections alive across Publish calls.
+// Connections are keyed by owner client, scheme and host.
+type connManager struct {
+	mutex sync.Mutex
+	conns map[string]*hekaConn
+}
+
+func newConnManager() *connManager {
+	return &connManager{conns: make(map[string]*hekaConn)}
+}
+
+func connKey(scheme, host string) string {
+	return fmt.Sprintf("%s://%s", scheme, host)
+}
+
+func ownerKey(owner uint64, scheme, host string) string {
+	return fmt.Sprintf("%d/%s", owner, connKey(scheme, host))
+}
+
+// dialFunc opens a new network connection to Heka
+type dialFunc func() (net.Conn, error)
+
+// get returns an open connection to the given scheme and host.
+// A new connection is opened with dial when none exists yet, when the
+// cached one is found broken or when it has been unused for idleTimeout
+// (zero keeps connections open whatever their idle time).
+func (cm *connManager) get(owner uint64, scheme, host string, idleTimeout time.Duration, dial dialFunc) (*hekaConn, error) {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
+	key := ownerKey(owner, scheme, host)
+	if hc, ok := cm.conns[key]; ok {
+		idle := time.Since(hc.lastUsed)
+		if idleTimeout > 0 && idle >= idleTimeout {
+			logger.WithField("_block", "connManager").Debug(
+				fmt.Sprintf("Closing connection to %s idle for %v", key, idle))
+		} else if idle < probeIdle || !hc.isBroken() {
+			return hc, nil
+		}
+		hc.Close()
+		delete(cm.conns, key)
+	}
+
+	logger.WithField("_block", "connManager").Debug(
+		fmt.Sprintf("Dialing Heka at %s", key))
+	conn, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	hc := &hekaConn{cm: cm, owner: owner, scheme: scheme, host: host, conn: conn, lastUsed: time.Now()}
+	cm.conns[key] = hc
+	return hc, nil
+}
+
+// drop closes the given connection and removes it from the manager
+// so that the next get dials again
+func (cm *connManager) drop(hc *hekaConn) {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
+	key := ownerKey(hc.owner, hc.scheme, hc.host)
+	if cur, ok := cm.conns[key]; ok && cur == hc {
+		delete(cm.conns, key)
+	}
+	hc.Close()
+}
+
+// dropStale closes the connection to the given scheme and host when its
+// remote address is not one of addrs, and tells whether it did
+func (cm *connManager) dropStale(owner uint64, scheme, host string, addrs []string) bool {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
+	key := ownerKey(owner, scheme, host)
+	hc, ok := cm.conns[key]
+	if !ok {
+		return false
+	}
+	remote, _, err := net.SplitHostPort(hc.conn.RemoteAddr().String())
+	if err == nil {
+		for _, a := range addrs {
+			if ip := net.ParseIP(a); ip != nil && ip.Equal(net.ParseIP(remote)) {
+				return false
+			}
+		}
+	}
+	hc.Close()
+	delete(cm.conns, key)
+	return true
+}
+
+// closeOwner closes the connections of a client
+func (cm *connManager) closeOwner(owner uint64) {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
+	for key, hc := range cm.conns {
+		if hc.owner == owner {
+			hc.Close()
+			delete(cm.conns, key)
+		}
+	}
+}
+
+// closeAll closes every connection held by the manager
+func (cm *connManager) closeAll() {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
+	for key, hc := range cm.conns {
+		hc.Close()
+		delete(cm.conns, key)
+	}
+}
@@ -0,0 +1,134 @@
+//
+// +build unit
+
+package snapheka
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// acceptAll accepts connections on l and hands them to the returned channel
+func acceptAll(l net.Listener) chan net.Conn {
+	accepted := make(chan net.Conn, 10)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				close(accepted)
+				return
+			}
+			accepted <- c
+		}
+	}()
+	return accepted
+}
+
+// readAll accepts one connection on l and hands everything read from it,
+// once the client has closed it, to the returned channel
+func readAll(l net.Listener) <-chan []byte {
+	received := make(chan []byte, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			close(received)
+			return
+		}
+		defer c.Close()
+		b, _ := ioutil.ReadAll(c)
+		received <- b
+	}()
+	return received
+}
+
+func TestConnManager(t *testing.T) {
+	Convey("Create a connection manager", t, func() {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		defer l.Close()
+		accepted := acceptAll(l)
+		cm := newConnManager()
+		defer cm.closeAll()
+		addr := l.Addr().String()
+		dial := func() (net.Conn, error) { return net.Dial("tcp", addr) }
+
+		Convey("Connections should be reused across calls", func() {
+			hc1, err := cm.get(1, "tcp", addr, 0, dial)
+			So(err, ShouldBeNil)
+			hc2, err := cm.get(1, "tcp", addr, 0, dial)
+			So(err, ShouldBeNil)
+			So(hc2, ShouldEqual, hc1)
+			So(hc1.SendMessage([]byte("abc")), ShouldBeNil)
+		})
+
+		Convey("A write without timeout should not keep the deadline of a previous one", func() {
+			hc, err := cm.get(1, "tcp", addr, 0, dial)
+			So(err, ShouldBeNil)
+			So(hc.sendWithTimeout([]byte("abc"), time.Second), ShouldBeNil)
+			// as if the deadline of that write had passed
+			So(hc.conn.SetWriteDeadline(time.Now().Add(-time.Second)), ShouldBeNil)
+			So(hc.SendMessage([]byte("abc")), ShouldBeNil)
+		})
+
+		Convey("A connection closed by the peer should be re-dialed", func() {
+			hc1, err := cm.get(1, "tcp", addr, 0, dial)
+			So(err, ShouldBeNil)
+			peer := <-accepted
+			peer.Close()
+			// unused for long enough to be probed
+			hc1.lastUsed = time.Now().Add(-2 * probeIdle)
+			hc2, err := cm.get(1, "tcp", addr, 0, dial)
+			So(err, ShouldBeNil)
+			So(hc2, ShouldNotEqual, hc1)
+		})
+
+		Convey("A dropped connection should be re-dialed", func() {
+			hc1, err := cm.get(1, "tcp", addr, 0, dial)
+			So(err, ShouldBeNil)
+			cm.drop(hc1)
+			hc2, err := cm.get(1, "tcp", addr, 0, dial)
+			So(err, ShouldBeNil)
+			So(hc2, ShouldNotEqual, hc1)
+		})
+
+		Convey("A connection idle for longer than the idle timeout should be re-dialed", func() {
+			hc1, err := cm.get(1, "tcp", addr, 0, dial)
+			So(err, ShouldBeNil)
+			hc2, err := cm.get(1, "tcp", addr, time.Hour, dial)
+			So(err, ShouldBeNil)
+			So(hc2, ShouldEqual, hc1)
+			hc1.lastUsed = time.Now().Add(-time.Minute)
+			hc3, err := cm.get(1, "tcp", addr, time.Second, dial)
+			So(err, ShouldBeNil)
+			So(hc3, ShouldNotEqual, hc1)
+		})
+
+		Convey("Clients should not share connections", func() {
+			hc1, err := cm.get(1, "tcp", addr, 0, dial)
+			So(err, ShouldBeNil)
+			hc2, err := cm.get(2, "tcp", addr, 0, dial)
+			So(err, ShouldBeNil)
+			So(hc2, ShouldNotEqual, hc1)
+			cm.closeOwner(1)
+			hc3, err := cm.get(1, "tcp", addr, 0, dial)
+			So(err, ShouldBeNil)
+			So(hc3, ShouldNotEqual, hc1)
+			hc4, err := cm.get(2, "tcp", addr, 0, dial)
+			So(err, ShouldBeNil)
+			So(hc4, ShouldEqual, hc2)
+		})
+
+		Convey("Dialing an address with no listener should fail", func() {
+			l2, err := net.Listen("tcp", "127.0.0.1:0")
+			So(err, ShouldBeNil)
+			closedAddr := l2.Addr().String()
+			l2.Close()
+			_, err = cm.get(1, "tcp", closedAddr, 0, func() (net.Conn, error) { return net.Dial("tcp", closedAddr) })
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
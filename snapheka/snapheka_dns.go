@@ -0,0 +1,131 @@
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2016 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package snapheka
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Endpoints are only resolved when dialing by default
+const dfltDNSRefresh = time.Duration(0)
+
+// DNS lookups, replaced in tests
+var (
+	lookupHost = net.LookupHost
+	lookupSRV  = net.LookupSRV
+)
+
+// discoverSRV looks up the DNS SRV record name (e.g. _heka._tcp.example.com)
+// and returns the Heka endpoints it lists, in order of priority
+func discoverSRV(name string, scheme string) ([]string, error) {
+	_, srvs, err := lookupSRV("", "", name)
+	if err != nil {
+		return nil, fmt.Errorf("looking up SRV record %s: %v", name, err)
+	}
+	seen := make(map[string]bool)
+	var endpoints []string
+	for _, srv := range srvs {
+		target := strings.TrimSuffix(srv.Target, ".")
+		// a target of "." means that the service is not available
+		if len(target) == 0 || srv.Port == 0 {
+			continue
+		}
+		ep := net.JoinHostPort(target, strconv.Itoa(int(srv.Port)))
+		if !seen[ep] {
+			seen[ep] = true
+			endpoints = append(endpoints, fmt.Sprintf("%s://%s", scheme, ep))
+		}
+	}
+	if len(endpoints) == 0 {
+		return nil, fmt.Errorf("SRV record %s lists no Heka endpoint", name)
+	}
+	return endpoints, nil
+}
+
+// refreshDNS looks up the Heka endpoints again once dnsRefresh has elapsed
+// since the last time. With an SRV record the endpoint list is replaced
+// when it changed. Connections to a host whose addresses no longer include
+// the connected one are closed, so that the next message dials again.
+func (shc *SnapHekaClient) refreshDNS() {
+	if shc.dnsRefresh <= 0 || shc.isUnixSocket() || time.Since(shc.resolvedAt) < shc.dnsRefresh {
+		return
+	}
+	shc.resolvedAt = time.Now()
+
+	if len(shc.srvName) > 0 {
+		shc.refreshSRV()
+	}
+	for _, hostport := range shc.hekaHosts {
+		host, _, err := net.SplitHostPort(hostport)
+		if err != nil || net.ParseIP(stripZone(host)) != nil {
+			continue
+		}
+		addrs, err := lookupHost(host)
+		if err != nil {
+			logger.WithField("_block", "refreshDNS").Warning(
+				fmt.Sprintf("resolving %s failed, keeping the current connection: %v", host, err))
+			continue
+		}
+		if hekaConns.dropStale(shc.id, shc.hekaScheme, hostport, addrs) {
+			logger.WithField("_block", "refreshDNS").Info(
+				fmt.Sprintf("%s now resolves to %s, reconnecting", host, strings.Join(addrs, ",")))
+		}
+	}
+}
+
+// refreshSRV replaces the endpoints with the ones listed by the SRV record
+func (shc *SnapHekaClient) refreshSRV() {
+	endpoints, err := discoverSRV(shc.srvName, shc.hekaScheme)
+	if err != nil {
+		logger.WithField("_block", "refreshSRV").Warning(
+			fmt.Sprintf("keeping the current Heka endpoints: %v", err))
+		return
+	}
+	hosts := make([]string, len(endpoints))
+	for i, ep := range endpoints {
+		hosts[i] = strings.TrimPrefix(ep, shc.hekaScheme+"://")
+	}
+	if strings.Join(hosts, ",") == strings.Join(shc.hekaHosts, ",") {
+		return
+	}
+	b, err := newBalancer(shc.balancer.strategy, hosts, shc.balancer.cooldown)
+	if err != nil {
+		logger.WithField("_block", "refreshSRV").Warning(
+			fmt.Sprintf("keeping the current Heka endpoints: %v", err))
+		return
+	}
+	logger.WithField("_block", "refreshSRV").Info(
+		fmt.Sprintf("Heka endpoints of %s are now %s", shc.srvName, strings.Join(hosts, ",")))
+	kept := make(map[string]bool)
+	for _, h := range hosts {
+		kept[h] = true
+	}
+	for _, h := range shc.hekaHosts {
+		if !kept[h] {
+			hekaConns.dropStale(shc.id, shc.hekaScheme, h, nil)
+		}
+	}
+	shc.hekaHosts = hosts
+	shc.balancer = b
+}
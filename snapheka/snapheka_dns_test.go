@@ -0,0 +1,118 @@
+//
+// +build unit
+
+package snapheka
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/intelsdi-x/snap/core/ctypes"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// stubSRV makes SRV lookups return the given records
+func stubSRV(srvs []*net.SRV, err error) {
+	lookupSRV = func(service, proto, name string) (string, []*net.SRV, error) {
+		return name, srvs, err
+	}
+}
+
+func listenerSRV(l net.Listener) *net.SRV {
+	addr := l.Addr().(*net.TCPAddr)
+	return &net.SRV{Target: addr.IP.String() + ".", Port: uint16(addr.Port)}
+}
+
+func TestHekaDNS(t *testing.T) {
+	defer func() {
+		lookupHost = net.LookupHost
+		lookupSRV = net.LookupSRV
+		hekaConns.closeAll()
+	}()
+
+	Convey("Discover Heka endpoints with an SRV record", t, func() {
+		Convey("Targets should be listed in order without duplicates", func() {
+			stubSRV([]*net.SRV{
+				{Target: "heka1.example.com.", Port: 5565},
+				{Target: "heka2.example.com.", Port: 5566},
+				{Target: "heka1.example.com.", Port: 5565},
+			}, nil)
+			endpoints, err := discoverSRV("_heka._tcp.example.com", "tcp")
+			So(err, ShouldBeNil)
+			So(endpoints, ShouldResemble, []string{"tcp://heka1.example.com:5565", "tcp://heka2.example.com:5566"})
+		})
+		Convey("A record without targets should be an error", func() {
+			stubSRV([]*net.SRV{{Target: ".", Port: 0}}, nil)
+			_, err := discoverSRV("_heka._tcp.example.com", "tcp")
+			So(err, ShouldNotBeNil)
+			stubSRV(nil, errors.New("no such host"))
+			_, err = discoverSRV("_heka._tcp.example.com", "tcp")
+			So(err, ShouldNotBeNil)
+		})
+		Convey("srv-record should replace host and port", func() {
+			stubSRV([]*net.SRV{{Target: "heka1.example.com.", Port: 5565}}, nil)
+			config := map[string]ctypes.ConfigValue{
+				"srv-record": ctypes.ConfigValueStr{Value: "_heka._tcp.example.com"},
+			}
+			addr, err := hekaAddress(config, true)
+			So(err, ShouldBeNil)
+			So(addr, ShouldEqual, "tls://heka1.example.com:5565")
+			config["host"] = ctypes.ConfigValueStr{Value: "heka"}
+			_, err = hekaAddress(config, false)
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Look up the Heka endpoints again", t, func() {
+		l1, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		defer l1.Close()
+		accepted1 := acceptAll(l1)
+		l2, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		defer l2.Close()
+		accepted2 := acceptAll(l2)
+
+		Convey("A connection to an address which is gone should be closed", func() {
+			port := strconv.Itoa(l1.Addr().(*net.TCPAddr).Port)
+			lookupHost = func(host string) ([]string, error) { return []string{"127.0.0.1"}, nil }
+			shc, err := NewSnapHekaClient("tcp://localhost:"+port, "")
+			So(err, ShouldBeNil)
+			shc.dnsRefresh = time.Nanosecond
+			So(shc.sendToHeka(mockMetrics(1)), ShouldBeNil)
+			So(hekaConns.dropStale(shc.id, "tcp", "localhost:"+port, []string{"127.0.0.1", "::1"}), ShouldBeFalse)
+
+			lookupHost = func(host string) ([]string, error) { return []string{"192.0.2.1"}, nil }
+			shc.refreshDNS()
+			So(hekaConns.dropStale(shc.id, "tcp", "localhost:"+port, nil), ShouldBeFalse)
+			<-accepted1
+		})
+		Convey("A changed SRV record should replace the endpoints", func() {
+			stubSRV([]*net.SRV{listenerSRV(l1)}, nil)
+			config := map[string]ctypes.ConfigValue{
+				"srv-record":  ctypes.ConfigValueStr{Value: "_heka._tcp.example.com"},
+				"dns-refresh": ctypes.ConfigValueStr{Value: "1ns"},
+			}
+			shc, err := newClientFromConfig(config)
+			So(err, ShouldBeNil)
+			So(shc.hekaHosts, ShouldResemble, []string{l1.Addr().String()})
+			So(shc.sendToHeka(mockMetrics(1)), ShouldBeNil)
+			<-accepted1
+
+			stubSRV([]*net.SRV{listenerSRV(l2)}, nil)
+			So(shc.sendToHeka(mockMetrics(1)), ShouldBeNil)
+			So(shc.hekaHosts, ShouldResemble, []string{l2.Addr().String()})
+			<-accepted2
+
+			Convey("A failed lookup should keep the endpoints", func() {
+				stubSRV(nil, errors.New("no such host"))
+				So(shc.sendToHeka(mockMetrics(1)), ShouldBeNil)
+				So(shc.hekaHosts, ShouldResemble, []string{l2.Addr().String()})
+			})
+		})
+	})
+}
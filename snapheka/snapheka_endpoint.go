@@ -0,0 +1,180 @@
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2016 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package snapheka
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Schemes of the Heka endpoints. tls is tcp with TLS on top, unix and
+// unixgram are stream and datagram unix domain sockets, http and https
+// post to an HttpListenInput.
+var endpointSchemes = map[string]bool{
+	"tcp":      true,
+	"udp":      true,
+	"tls":      true,
+	"unix":     true,
+	"unixgram": true,
+	"http":     true,
+	"https":    true,
+}
+
+// endpoint is a parsed Heka address
+type endpoint struct {
+	scheme string
+	// host:port with IPv6 literals in brackets, or the socket path for
+	// the unix schemes
+	addr string
+}
+
+func (e endpoint) String() string {
+	return fmt.Sprintf("%s://%s", e.scheme, e.addr)
+}
+
+// parseEndpoint parses a Heka endpoint given as a URL (e.g. tcp://host:port,
+// tls://[::1]:5565 or unix:///var/run/heka.sock), a host:port string, an
+// IPv6 literal or a hostname. dfltScheme is used when there is no scheme and
+// dfltPort when there is no port; a missing port is an error when dfltPort
+// is 0.
+func parseEndpoint(s string, dfltScheme string, dfltPort int) (endpoint, error) {
+	s = strings.TrimSpace(s)
+	if len(s) == 0 {
+		return endpoint{}, fmt.Errorf("empty Heka endpoint")
+	}
+	e := endpoint{scheme: dfltScheme}
+	rest := s
+	if i := strings.Index(s, "://"); i >= 0 {
+		e.scheme = strings.ToLower(s[:i])
+		rest = s[i+3:]
+	}
+	if !endpointSchemes[e.scheme] {
+		return endpoint{}, fmt.Errorf("invalid Heka endpoint '%s': unknown scheme '%s' (should be one of tcp udp tls unix unixgram http https)",
+			s, e.scheme)
+	}
+
+	if e.scheme == "unix" || e.scheme == "unixgram" {
+		if len(rest) == 0 {
+			return endpoint{}, fmt.Errorf("invalid Heka endpoint '%s': missing socket path", s)
+		}
+		e.addr = rest
+		return e, nil
+	}
+
+	if strings.ContainsAny(rest, "/?#@") {
+		return endpoint{}, fmt.Errorf("invalid Heka endpoint '%s': only a host and a port are expected", s)
+	}
+	host, port, err := splitHostPort(rest)
+	if err != nil {
+		return endpoint{}, fmt.Errorf("invalid Heka endpoint '%s': %v", s, err)
+	}
+	if err = checkHost(host); err != nil {
+		return endpoint{}, fmt.Errorf("invalid Heka endpoint '%s': %v", s, err)
+	}
+	p := dfltPort
+	if len(port) > 0 {
+		if p, err = strconv.Atoi(port); err != nil {
+			return endpoint{}, fmt.Errorf("invalid Heka endpoint '%s': port '%s' is not a number", s, port)
+		}
+	}
+	if p == 0 && len(port) == 0 {
+		return endpoint{}, fmt.Errorf("invalid Heka endpoint '%s': missing port", s)
+	}
+	if p < 1 || p > 65535 {
+		return endpoint{}, fmt.Errorf("invalid Heka endpoint '%s': port %d is out of range", s, p)
+	}
+	e.addr = net.JoinHostPort(host, strconv.Itoa(p))
+	return e, nil
+}
+
+// splitHostPort splits host:port, [ipv6]:port, [ipv6], a bare IPv6 literal
+// or a hostname into the host and the port, which is empty when missing
+func splitHostPort(s string) (host, port string, err error) {
+	switch {
+	case strings.HasPrefix(s, "["):
+		end := strings.Index(s, "]")
+		if end < 0 {
+			return "", "", fmt.Errorf("missing ']' in IPv6 address")
+		}
+		host = s[1:end]
+		if net.ParseIP(stripZone(host)) == nil || !strings.Contains(host, ":") {
+			return "", "", fmt.Errorf("'%s' is not an IPv6 address", host)
+		}
+		switch after := s[end+1:]; {
+		case len(after) == 0:
+		case strings.HasPrefix(after, ":") && len(after) > 1:
+			port = after[1:]
+		default:
+			return "", "", fmt.Errorf("unexpected '%s' after IPv6 address", after)
+		}
+		return host, port, nil
+	case strings.Count(s, ":") > 1:
+		// a bare IPv6 literal can not carry a port
+		if net.ParseIP(stripZone(s)) == nil {
+			return "", "", fmt.Errorf("'%s' is not an IPv6 address (use [address]:port to give a port)", s)
+		}
+		return s, "", nil
+	case strings.Contains(s, ":"):
+		host, port, err = net.SplitHostPort(s)
+		if err == nil && len(port) == 0 {
+			err = fmt.Errorf("missing port after ':'")
+		}
+		return host, port, err
+	default:
+		return s, "", nil
+	}
+}
+
+// stripZone removes the zone (e.g. %eth0) of an IPv6 address
+func stripZone(host string) string {
+	if i := strings.LastIndex(host, "%"); i >= 0 {
+		return host[:i]
+	}
+	return host
+}
+
+// checkHost verifies that host is an IP address or a valid hostname
+func checkHost(host string) error {
+	if len(host) == 0 {
+		return fmt.Errorf("missing host")
+	}
+	if net.ParseIP(stripZone(host)) != nil {
+		return nil
+	}
+	if len(host) > 253 {
+		return fmt.Errorf("hostname is longer than 253 characters")
+	}
+	for _, label := range strings.Split(strings.TrimSuffix(host, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return fmt.Errorf("'%s' is not a valid hostname", host)
+		}
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return fmt.Errorf("'%s' is not a valid hostname", host)
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return fmt.Errorf("'%s' is not a valid hostname", host)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+//
+// +build unit
+
+package snapheka
+
+import (
+	"net"
+	"testing"
+
+	"github.com/intelsdi-x/snap/core/ctypes"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestParseEndpoint(t *testing.T) {
+	Convey("Parse Heka endpoints", t, func() {
+		Convey("Valid endpoints should be normalized", func() {
+			valid := map[string]string{
+				"localhost":                    "tcp://localhost:5565",
+				"heka.example.com:6000":        "tcp://heka.example.com:6000",
+				"192.168.1.10":                 "tcp://192.168.1.10:5565",
+				"192.168.1.10:6000":            "tcp://192.168.1.10:6000",
+				"::1":                          "tcp://[::1]:5565",
+				"[::1]":                        "tcp://[::1]:5565",
+				"[2001:db8::1]:6000":           "tcp://[2001:db8::1]:6000",
+				"[fe80::1%eth0]:6000":          "tcp://[fe80::1%eth0]:6000",
+				"udp://heka:6000":              "udp://heka:6000",
+				"TLS://[2001:db8::1]":          "tls://[2001:db8::1]:5565",
+				"unix:///var/run/heka.sock":    "unix:///var/run/heka.sock",
+				"unixgram:///tmp/heka.sock":    "unixgram:///tmp/heka.sock",
+				" heka_1.internal:6000 ":       "tcp://heka_1.internal:6000",
+				"tcp://heka.example.com.:6000": "tcp://heka.example.com.:6000",
+			}
+			for s, expected := range valid {
+				e, err := parseEndpoint(s, "tcp", 5565)
+				So(err, ShouldBeNil)
+				So(e.String(), ShouldEqual, expected)
+			}
+		})
+		Convey("Invalid endpoints should be rejected with the reason", func() {
+			invalid := map[string]string{
+				"":                      "empty",
+				"sctp://heka:6000":      "unknown scheme",
+				"tcp://heka:6000/path":  "only a host and a port",
+				"user@heka:6000":        "only a host and a port",
+				"heka:port":             "not a number",
+				"heka:70000":            "out of range",
+				"heka:":                 "missing port",
+				"[::1":                  "missing ']'",
+				"[::1]6000":             "unexpected",
+				"[10.0.0.1]:6000":       "not an IPv6 address",
+				"2001:db8::zz":          "not an IPv6 address",
+				"-heka.example.com":     "not a valid hostname",
+				"heka..example.com":     "not a valid hostname",
+				"heka example.com:6000": "not a valid hostname",
+				"unix://":               "missing socket path",
+				"tcp://:6000":           "missing host",
+			}
+			for s, reason := range invalid {
+				_, err := parseEndpoint(s, "tcp", 5565)
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, reason)
+			}
+		})
+		Convey("A missing port should be an error without default", func() {
+			_, err := parseEndpoint("localhost", "tcp", 0)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "missing port")
+		})
+	})
+
+	Convey("Build the Heka address from host and port", t, func() {
+		config := map[string]ctypes.ConfigValue{
+			"port": ctypes.ConfigValueInt{Value: 5565},
+		}
+
+		Convey("IPv6 literals should be bracketed", func() {
+			config["host"] = ctypes.ConfigValueStr{Value: "2001:db8::1"}
+			addr, err := hekaAddress(config, false)
+			So(err, ShouldBeNil)
+			So(addr, ShouldEqual, "tcp://[2001:db8::1]:5565")
+		})
+		Convey("host may give the port and the scheme", func() {
+			config["host"] = ctypes.ConfigValueStr{Value: "udp://heka:5565"}
+			addr, err := hekaAddress(config, false)
+			So(err, ShouldBeNil)
+			So(addr, ShouldEqual, "udp://heka:5565")
+			config["host"] = ctypes.ConfigValueStr{Value: "heka:6000"}
+			delete(config, "port")
+			addr, err = hekaAddress(config, true)
+			So(err, ShouldBeNil)
+			So(addr, ShouldEqual, "tls://heka:6000")
+		})
+		Convey("Conflicting settings should be rejected", func() {
+			config["host"] = ctypes.ConfigValueStr{Value: "heka:6000"}
+			_, err := hekaAddress(config, false)
+			So(err, ShouldNotBeNil)
+			config["host"] = ctypes.ConfigValueStr{Value: "udp://heka:5565"}
+			_, err = hekaAddress(config, true)
+			So(err, ShouldNotBeNil)
+			config["host"] = ctypes.ConfigValueStr{Value: "heka/metrics"}
+			_, err = hekaAddress(config, false)
+			So(err, ShouldNotBeNil)
+		})
+		Convey("Endpoints should be validated", func() {
+			delete(config, "port")
+			delete(config, "host")
+			config["endpoints"] = ctypes.ConfigValueStr{Value: "[::1]:5565, heka2:5565"}
+			addr, err := hekaAddress(config, false)
+			So(err, ShouldBeNil)
+			So(addr, ShouldEqual, "tcp://[::1]:5565,tcp://heka2:5565")
+			config["endpoints"] = ctypes.ConfigValueStr{Value: "heka1:5565,heka2"}
+			_, err = hekaAddress(config, false)
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Send metrics to an IPv6 listener", t, func() {
+		l, err := net.Listen("tcp", "[::1]:0")
+		if err != nil {
+			SkipSo("IPv6 loopback is not available")
+			return
+		}
+		defer l.Close()
+		defer hekaConns.closeAll()
+		received := readAll(l)
+		port := l.Addr().(*net.TCPAddr).Port
+		config := map[string]ctypes.ConfigValue{
+			"host": ctypes.ConfigValueStr{Value: "::1"},
+			"port": ctypes.ConfigValueInt{Value: port},
+		}
+		shc, err := newClientFromConfig(config)
+		So(err, ShouldBeNil)
+		So(shc.sendToHeka(mockMetrics(1)), ShouldBeNil)
+		hekaConns.closeAll()
+		n, err := countFrames(<-received)
+		So(err, ShouldBeNil)
+		So(n, ShouldEqual, 1)
+	})
+}
@@ -0,0 +1,254 @@
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2016 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package snapheka
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+
+	"github.com/intelsdi-x/snap/control/plugin"
+	"github.com/intelsdi-x/snap/core/ctypes"
+)
+
+const (
+	// What to do with unsigned integers larger than the largest int64
+	overflowSaturate = "saturate"
+	overflowDouble   = "double"
+	overflowString   = "string"
+
+	dfltNumericOverflow = overflowSaturate
+
+	dfltFlattenMaxDepth  = 5
+	dfltFlattenMaxFields = 100
+)
+
+// fieldOptions tells how the data of a metric is converted into the
+// fields of its Heka message
+type fieldOptions struct {
+	numericOverflow string
+	// Expansion of maps, slices and structs into several fields
+	flatten          bool
+	flattenMaxDepth  int
+	flattenMaxFields int
+	// Optional fields of the metric metadata
+	unitField        bool
+	descriptionField bool
+	versionField     bool
+	// Whether the publish_timestamp field is set, with timestamp-source both
+	publishTimestamp bool
+	// Naming of the fields of dynamic elements and tags
+	tagPrefix         string
+	dimensionPrefix   string
+	reservedCollision string
+	fieldOverride     string
+	// Filters of the tags, dynamic elements and fields of the plugin
+	tagFilter       nameFilter
+	dimensionFilter nameFilter
+	fieldFilter     nameFilter
+	// Constant fields added to every message, and whether they are
+	// listed in the dimensions field
+	staticFields     []staticField
+	staticDimensions bool
+}
+
+func newFieldOptions() fieldOptions {
+	return fieldOptions{
+		numericOverflow:   dfltNumericOverflow,
+		flattenMaxDepth:   dfltFlattenMaxDepth,
+		flattenMaxFields:  dfltFlattenMaxFields,
+		reservedCollision: dfltReservedCollision,
+		fieldOverride:     dfltFieldOverride,
+	}
+}
+
+// fieldOptionsFromConfig reads the field conversion settings from the task
+// config
+func fieldOptionsFromConfig(config map[string]ctypes.ConfigValue) (fieldOptions, error) {
+	opts := newFieldOptions()
+	opts.numericOverflow = configString(config, "numeric-overflow", opts.numericOverflow)
+	switch opts.numericOverflow {
+	case overflowSaturate, overflowDouble, overflowString:
+	default:
+		return opts, fmt.Errorf("unknown numeric-overflow '%s' (should be one of %s %s %s)",
+			opts.numericOverflow, overflowSaturate, overflowDouble, overflowString)
+	}
+	opts.flatten = configBool(config, "flatten", opts.flatten)
+	opts.flattenMaxDepth = configInt(config, "flatten-max-depth", opts.flattenMaxDepth)
+	opts.flattenMaxFields = configInt(config, "flatten-max-fields", opts.flattenMaxFields)
+	if opts.flattenMaxDepth < 1 || opts.flattenMaxFields < 1 {
+		return opts, fmt.Errorf("flatten-max-depth and flatten-max-fields must be at least 1")
+	}
+	opts.unitField = configBool(config, "unit-field", opts.unitField)
+	opts.descriptionField = configBool(config, "description-field", opts.descriptionField)
+	opts.versionField = configBool(config, "version-field", opts.versionField)
+	opts.publishTimestamp = configString(config, "timestamp-source", dfltTimestampSource) == tsSourceBoth
+	opts.tagPrefix = configString(config, "tag-prefix", opts.tagPrefix)
+	opts.dimensionPrefix = configString(config, "dimension-prefix", opts.dimensionPrefix)
+	opts.reservedCollision = configString(config, "reserved-collision", opts.reservedCollision)
+	switch opts.reservedCollision {
+	case collisionRename, collisionDrop, collisionReject:
+	default:
+		return opts, fmt.Errorf("unknown reserved-collision '%s' (should be one of %s %s %s)",
+			opts.reservedCollision, collisionRename, collisionDrop, collisionReject)
+	}
+	opts.fieldOverride = configString(config, "field-override", opts.fieldOverride)
+	switch opts.fieldOverride {
+	case overrideDimension, overrideTag:
+	default:
+		return opts, fmt.Errorf("unknown field-override '%s' (should be one of %s %s)",
+			opts.fieldOverride, overrideDimension, overrideTag)
+	}
+	var err error
+	if opts.tagFilter, err = nameFilterFromConfig(config, "tag"); err != nil {
+		return opts, err
+	}
+	if opts.dimensionFilter, err = nameFilterFromConfig(config, "dimension"); err != nil {
+		return opts, err
+	}
+	if opts.fieldFilter, err = nameFilterFromConfig(config, "field"); err != nil {
+		return opts, err
+	}
+	if opts.staticFields, err = staticFieldsFromConfig(config); err != nil {
+		return opts, err
+	}
+	for _, sf := range opts.staticFields {
+		if opts.reserved(sf.name) {
+			return opts, fmt.Errorf("static field %s has the name of a field of the plugin", sf.name)
+		}
+	}
+	opts.staticDimensions = configBool(config, "static-dimensions", opts.staticDimensions)
+	return opts, nil
+}
+
+// convertValue converts the data of a metric into one of the types of the
+// Heka fields: string, []byte, int64, float64 or bool. Integers are sent as
+// int64, unsigned integers which do not fit are handled with the overflow
+// policy, float32 keep their shortest decimal representation and times are
+// sent in nanoseconds since the epoch.
+func (opts fieldOptions) convertValue(v interface{}) (interface{}, error) {
+	switch d := v.(type) {
+	case string, []byte, int64, float64, bool:
+		return d, nil
+	case int:
+		return int64(d), nil
+	case int8:
+		return int64(d), nil
+	case int16:
+		return int64(d), nil
+	case int32:
+		return int64(d), nil
+	case uint8:
+		return int64(d), nil
+	case uint16:
+		return int64(d), nil
+	case uint32:
+		return int64(d), nil
+	case uint:
+		return opts.convertUint(uint64(d)), nil
+	case uint64:
+		return opts.convertUint(d), nil
+	case uintptr:
+		return opts.convertUint(uint64(d)), nil
+	case float32:
+		f, _ := strconv.ParseFloat(strconv.FormatFloat(float64(d), 'g', -1, 32), 64)
+		return f, nil
+	case time.Time:
+		return d.UnixNano(), nil
+	case nil:
+		return nil, fmt.Errorf("no data")
+	default:
+		return nil, fmt.Errorf("%T data is not supported", d)
+	}
+}
+
+func (opts fieldOptions) convertUint(u uint64) interface{} {
+	if u <= math.MaxInt64 {
+		return int64(u)
+	}
+	switch opts.numericOverflow {
+	case overflowDouble:
+		return float64(u)
+	case overflowString:
+		return strconv.FormatUint(u, 10)
+	default:
+		return int64(math.MaxInt64)
+	}
+}
+
+// addValueField adds the data of a metric to msg, flattened into several
+// fields when enabled. rep is the representation of the fields.
+func (opts fieldOptions) addValueField(name string, v interface{}, rep string, msg *message.Message) error {
+	if opts.flatten {
+		return opts.addFlattened(name, v, rep, msg)
+	}
+	if !opts.fieldFilter.allows(name) {
+		return nil
+	}
+	return opts.addDataField(name, v, rep, msg)
+}
+
+// addDataField adds data to msg as a single field. Data which can not be
+// converted is added as its JSON text, and the name of the field is listed
+// in the unconverted_fields field so that the loss of type is reported.
+func (opts fieldOptions) addDataField(name string, v interface{}, rep string, msg *message.Message) error {
+	value, err := opts.convertValue(v)
+	if err == nil {
+		return addFieldRepresentation(name, value, rep, msg)
+	}
+	logger.WithField("_block", "addDataField").Warning(
+		fmt.Sprintf("Field %s sent as text: %v", name, err))
+	text := ""
+	if v != nil {
+		b, e := json.Marshal(v)
+		if e != nil {
+			b = []byte(fmt.Sprint(v))
+		}
+		text = string(b)
+	}
+	if err = addFieldRepresentation(name, text, rep, msg); err != nil {
+		return err
+	}
+	if !opts.fieldFilter.allows("unconverted_fields") {
+		return nil
+	}
+	if f := msg.FindFirstField("unconverted_fields"); f != nil {
+		return f.AddValue(name)
+	}
+	return addField("unconverted_fields", name, msg)
+}
+
+// addMetadataFields adds the unit, description and version of the metric
+// to msg when enabled. Empty units and descriptions are left out.
+func (opts fieldOptions) addMetadataFields(m plugin.MetricType, msg *message.Message) {
+	if opts.unitField && len(m.Unit()) > 0 && opts.fieldFilter.allows("unit") {
+		addField("unit", m.Unit(), msg)
+	}
+	if opts.descriptionField && len(m.Description()) > 0 && opts.fieldFilter.allows("description") {
+		addField("description", m.Description(), msg)
+	}
+	if opts.versionField && opts.fieldFilter.allows("metric_version") {
+		addField("metric_version", int64(m.Version()), msg)
+	}
+}
@@ -0,0 +1,155 @@
+//
+// +build unit
+
+package snapheka
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+
+	"github.com/intelsdi-x/snap/control/plugin"
+	"github.com/intelsdi-x/snap/core"
+	"github.com/intelsdi-x/snap/core/ctypes"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestFieldOptions(t *testing.T) {
+	Convey("Configure the field conversion", t, func() {
+		config := map[string]ctypes.ConfigValue{}
+
+		Convey("Defaults should be used when not set", func() {
+			opts, err := fieldOptionsFromConfig(config)
+			So(err, ShouldBeNil)
+			So(opts, ShouldResemble, newFieldOptions())
+		})
+		Convey("An unknown overflow policy should be rejected", func() {
+			config["numeric-overflow"] = ctypes.ConfigValueStr{Value: "wrap"}
+			_, err := fieldOptionsFromConfig(config)
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Convert metric data into Heka field values", t, func() {
+		opts := newFieldOptions()
+
+		Convey("Every integer type should be sent as int64", func() {
+			for _, v := range []interface{}{int(-7), int8(-7), int16(-7), int32(-7), int64(-7)} {
+				value, err := opts.convertValue(v)
+				So(err, ShouldBeNil)
+				So(value, ShouldEqual, int64(-7))
+			}
+			for _, v := range []interface{}{uint(7), uint8(7), uint16(7), uint32(7), uint64(7), uintptr(7)} {
+				value, err := opts.convertValue(v)
+				So(err, ShouldBeNil)
+				So(value, ShouldEqual, int64(7))
+			}
+			value, err := opts.convertValue(uint32(math.MaxUint32))
+			So(err, ShouldBeNil)
+			So(value, ShouldEqual, int64(math.MaxUint32))
+		})
+		Convey("float32 should keep its decimal value", func() {
+			value, err := opts.convertValue(float32(0.1))
+			So(err, ShouldBeNil)
+			So(value, ShouldEqual, 0.1)
+		})
+		Convey("Times should be sent in nanoseconds", func() {
+			ts := time.Unix(1500000000, 5)
+			value, err := opts.convertValue(ts)
+			So(err, ShouldBeNil)
+			So(value, ShouldEqual, ts.UnixNano())
+		})
+		Convey("Strings, bytes and bools should be kept", func() {
+			for _, v := range []interface{}{"up", []byte("up"), true} {
+				value, err := opts.convertValue(v)
+				So(err, ShouldBeNil)
+				So(value, ShouldResemble, v)
+			}
+		})
+		Convey("Unsigned integers above 2^63 should follow the overflow policy", func() {
+			big := uint64(math.MaxUint64)
+			value, err := opts.convertValue(big)
+			So(err, ShouldBeNil)
+			So(value, ShouldEqual, int64(math.MaxInt64))
+			opts.numericOverflow = overflowDouble
+			value, err = opts.convertValue(big)
+			So(err, ShouldBeNil)
+			So(value, ShouldEqual, float64(big))
+			opts.numericOverflow = overflowString
+			value, err = opts.convertValue(big)
+			So(err, ShouldBeNil)
+			So(value, ShouldEqual, "18446744073709551615")
+		})
+		Convey("Unsupported data should be an error", func() {
+			_, err := opts.convertValue(nil)
+			So(err, ShouldNotBeNil)
+			_, err = opts.convertValue(struct{ A int }{1})
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Add the value field of a metric", t, func() {
+		opts := newFieldOptions()
+		msg := &message.Message{}
+
+		Convey("Converted data should be added with its Heka type", func() {
+			So(opts.addValueField("value", int16(3), "", msg), ShouldBeNil)
+			So(msg.FindFirstField("value").GetValueType(), ShouldEqual, message.Field_INTEGER)
+			So(msg.FindFirstField("value").GetValue(), ShouldEqual, int64(3))
+			So(msg.FindFirstField("unconverted_fields"), ShouldBeNil)
+		})
+		Convey("Unsupported data should be sent as text and reported", func() {
+			So(opts.addValueField("value", struct{ A int }{1}, "", msg), ShouldBeNil)
+			So(opts.addValueField("other", nil, "", msg), ShouldBeNil)
+			So(msg.FindFirstField("value").GetValue(), ShouldEqual, `{"A":1}`)
+			So(msg.FindFirstField("other").GetValue(), ShouldEqual, "")
+			So(msg.FindFirstField("unconverted_fields").GetValueString(), ShouldResemble, []string{"value", "other"})
+		})
+	})
+
+	Convey("Add the metadata of a metric", t, func() {
+		opts := newFieldOptions()
+		m := *plugin.NewMetricType(core.NewNamespace("intel", "mock", "foo"), time.Now(), nil, "B/s", 7)
+		m.Description_ = "bytes read"
+		m.Version_ = 2
+
+		Convey("The unit should be the representation of the value", func() {
+			msg, err := createHekaMessage("", m, 1, "localhost", opts)
+			So(err, ShouldBeNil)
+			So(msg.FindFirstField("value").GetRepresentation(), ShouldEqual, "B/s")
+			So(msg.FindFirstField("unit"), ShouldBeNil)
+			So(msg.FindFirstField("description"), ShouldBeNil)
+			So(msg.FindFirstField("metric_version"), ShouldBeNil)
+		})
+		Convey("Flattened fields should share the representation", func() {
+			opts.flatten = true
+			m.Data_ = map[string]int{"read": 1}
+			msg, err := createHekaMessage("", m, 1, "localhost", opts)
+			So(err, ShouldBeNil)
+			So(msg.FindFirstField("value.read").GetRepresentation(), ShouldEqual, "B/s")
+		})
+		Convey("Enabled metadata fields should be added", func() {
+			opts.unitField = true
+			opts.descriptionField = true
+			opts.versionField = true
+			msg, err := createHekaMessage("", m, 1, "localhost", opts)
+			So(err, ShouldBeNil)
+			So(msg.FindFirstField("unit").GetValue(), ShouldEqual, "B/s")
+			So(msg.FindFirstField("description").GetValue(), ShouldEqual, "bytes read")
+			So(msg.FindFirstField("metric_version").GetValue(), ShouldEqual, int64(2))
+		})
+		Convey("Empty units and descriptions should be left out", func() {
+			opts.unitField = true
+			opts.descriptionField = true
+			m.Unit_ = ""
+			m.Description_ = ""
+			msg, err := createHekaMessage("", m, 1, "localhost", opts)
+			So(err, ShouldBeNil)
+			So(msg.FindFirstField("unit"), ShouldBeNil)
+			So(msg.FindFirstField("description"), ShouldBeNil)
+		})
+	})
+}
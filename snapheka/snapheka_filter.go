@@ -0,0 +1,137 @@
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2016 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package snapheka
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/intelsdi-x/snap/core/ctypes"
+)
+
+// nameFilter keeps the names matching one of the include glob patterns,
+// or every name when there is none, unless they match an exclude pattern
+type nameFilter struct {
+	include []string
+	exclude []string
+}
+
+// nameFilterFromConfig reads the comma separated glob patterns of the
+// <prefix>-include and <prefix>-exclude options
+func nameFilterFromConfig(config map[string]ctypes.ConfigValue, prefix string) (nameFilter, error) {
+	var nf nameFilter
+	var err error
+	if nf.include, err = globList(config, prefix+"-include"); err != nil {
+		return nf, err
+	}
+	nf.exclude, err = globList(config, prefix+"-exclude")
+	return nf, err
+}
+
+func globList(config map[string]ctypes.ConfigValue, key string) ([]string, error) {
+	var patterns []string
+	for _, p := range strings.Split(configString(config, key, ""), ",") {
+		p = strings.TrimSpace(p)
+		if len(p) == 0 {
+			continue
+		}
+		if err := checkGlob(p); err != nil {
+			return nil, fmt.Errorf("invalid pattern '%s' in %s: %v", p, key, err)
+		}
+		patterns = append(patterns, p)
+	}
+	return patterns, nil
+}
+
+// checkGlob verifies the syntax of a path.Match pattern. path.Match only
+// reports a bad pattern when matching reaches it, so the whole pattern is
+// scanned here instead.
+func checkGlob(p string) error {
+	for i := 0; i < len(p); i++ {
+		switch p[i] {
+		case '\\':
+			if i++; i >= len(p) {
+				return path.ErrBadPattern
+			}
+		case '[':
+			i++
+			if i < len(p) && p[i] == '^' {
+				i++
+			}
+			// a class holds at least one character or range before its ']'
+			for n := 0; i >= len(p) || p[i] != ']' || n == 0; n++ {
+				var err error
+				if i, err = globClassChar(p, i); err != nil {
+					return err
+				}
+				if i < len(p) && p[i] == '-' {
+					if i, err = globClassChar(p, i+1); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// globClassChar checks the character of a class at offset i of p, and
+// returns the offset following it
+func globClassChar(p string, i int) (int, error) {
+	if i >= len(p) || p[i] == '-' || p[i] == ']' {
+		return i, path.ErrBadPattern
+	}
+	if p[i] == '\\' {
+		if i++; i >= len(p) {
+			return i, path.ErrBadPattern
+		}
+	}
+	_, size := utf8.DecodeRuneInString(p[i:])
+	return i + size, nil
+}
+
+// allows tells whether name passes the filter
+func (nf nameFilter) allows(name string) bool {
+	if len(nf.include) > 0 && !matchAny(nf.include, name) {
+		return false
+	}
+	return !matchAny(nf.exclude, name)
+}
+
+// allowsNested tells whether name, nested in the root field (e.g.
+// value.read in value), passes the filter. Matching either name is
+// enough to be included, and excluded.
+func (nf nameFilter) allowsNested(root, name string) bool {
+	if len(nf.include) > 0 && !matchAny(nf.include, root) && !matchAny(nf.include, name) {
+		return false
+	}
+	return !matchAny(nf.exclude, root) && !matchAny(nf.exclude, name)
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,119 @@
+//
+// +build unit
+
+package snapheka
+
+import (
+	"path"
+	"testing"
+	"time"
+
+	"github.com/intelsdi-x/snap/control/plugin"
+	"github.com/intelsdi-x/snap/core"
+	"github.com/intelsdi-x/snap/core/ctypes"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestNameFilter(t *testing.T) {
+	Convey("Configure name filters", t, func() {
+		config := map[string]ctypes.ConfigValue{}
+
+		Convey("An empty filter should allow every name", func() {
+			nf, err := nameFilterFromConfig(config, "tag")
+			So(err, ShouldBeNil)
+			So(nf.allows("plugin_running_on"), ShouldBeTrue)
+		})
+		Convey("Patterns should be trimmed and checked", func() {
+			config["tag-include"] = ctypes.ConfigValueStr{Value: " rack*, dc ,"}
+			nf, err := nameFilterFromConfig(config, "tag")
+			So(err, ShouldBeNil)
+			So(nf.include, ShouldResemble, []string{"rack*", "dc"})
+			config["tag-exclude"] = ctypes.ConfigValueStr{Value: "[a"}
+			_, err = nameFilterFromConfig(config, "tag")
+			So(err, ShouldNotBeNil)
+		})
+		Convey("Patterns should be checked past their first mismatch", func() {
+			for _, p := range []string{"a[", "a[]", "a[b-", "a[^]", "a[]b]", "a\\", "a[b-]", "a[\\"} {
+				So(checkGlob(p), ShouldNotBeNil)
+			}
+			for _, p := range []string{"a[b]", "a[^b-d]", "a[\\]]", "a\\*", "a[é-ü]?", "*"} {
+				So(checkGlob(p), ShouldBeNil)
+				_, err := path.Match(p, "x")
+				So(err, ShouldBeNil)
+			}
+			config["field-include"] = ctypes.ConfigValueStr{Value: "name,a["}
+			_, err := fieldOptionsFromConfig(config)
+			So(err, ShouldNotBeNil)
+		})
+		Convey("Each filter should be read from its own options", func() {
+			config["dimension-exclude"] = ctypes.ConfigValueStr{Value: "cpu*"}
+			opts, err := fieldOptionsFromConfig(config)
+			So(err, ShouldBeNil)
+			So(opts.dimensionFilter.exclude, ShouldResemble, []string{"cpu*"})
+			So(opts.tagFilter, ShouldResemble, nameFilter{})
+		})
+	})
+
+	Convey("Filter names", t, func() {
+		Convey("Only names matching an include pattern should be allowed", func() {
+			nf := nameFilter{include: []string{"rack*", "dc"}}
+			So(nf.allows("rack1"), ShouldBeTrue)
+			So(nf.allows("dc"), ShouldBeTrue)
+			So(nf.allows("plugin_running_on"), ShouldBeFalse)
+		})
+		Convey("Exclude patterns should win over include patterns", func() {
+			nf := nameFilter{include: []string{"*"}, exclude: []string{"plugin_*"}}
+			So(nf.allows("rack1"), ShouldBeTrue)
+			So(nf.allows("plugin_running_on"), ShouldBeFalse)
+		})
+		Convey("Nested names should match on their own or on the root name", func() {
+			nf := nameFilter{include: []string{"value.*"}}
+			So(nf.allowsNested("value", "value.read"), ShouldBeTrue)
+			nf = nameFilter{include: []string{"value"}, exclude: []string{"value.errors"}}
+			So(nf.allowsNested("value", "value.read"), ShouldBeTrue)
+			So(nf.allowsNested("value", "value.errors"), ShouldBeFalse)
+			So(nf.allowsNested("other", "other.read"), ShouldBeFalse)
+		})
+	})
+
+	Convey("Filter the fields of Heka messages", t, func() {
+		opts := newFieldOptions()
+		ns := core.NewNamespace("intel", "mock").AddDynamicElement("cpu", "").AddStaticElement("load")
+		ns[2].Value = "0"
+		m := *plugin.NewMetricType(ns, time.Now(), map[string]string{"plugin_running_on": "h", "rack": "r1"}, "", 1)
+
+		Convey("Excluded tags should have no field nor dimension", func() {
+			opts.tagFilter = nameFilter{exclude: []string{"plugin_*"}}
+			msg, err := createHekaMessage("", m, 1, "localhost", opts)
+			So(err, ShouldBeNil)
+			So(msg.FindFirstField("plugin_running_on"), ShouldBeNil)
+			So(msg.FindFirstField("dimensions").GetValueString(), ShouldResemble, []string{"cpu", "rack"})
+		})
+		Convey("Dynamic elements should be filtered by name", func() {
+			opts.dimensionFilter = nameFilter{exclude: []string{"cpu"}}
+			msg, err := createHekaMessage("", m, 1, "localhost", opts)
+			So(err, ShouldBeNil)
+			So(msg.FindFirstField("cpu"), ShouldBeNil)
+			So(msg.FindFirstField("dimensions").GetValueString(), ShouldResemble, []string{"plugin_running_on", "rack"})
+		})
+		Convey("Fields of the plugin should be filtered by name", func() {
+			opts.fieldFilter = nameFilter{exclude: []string{"dimensions", "time*"}}
+			msg, err := createHekaMessage("", m, 1, "localhost", opts)
+			So(err, ShouldBeNil)
+			So(msg.FindFirstField("dimensions"), ShouldBeNil)
+			So(msg.FindFirstField("timestamp"), ShouldBeNil)
+			So(msg.FindFirstField("name"), ShouldNotBeNil)
+			So(msg.FindFirstField("value"), ShouldNotBeNil)
+		})
+		Convey("Flattened fields should be filtered by their full name", func() {
+			opts.flatten = true
+			opts.fieldFilter = nameFilter{exclude: []string{"value.write"}}
+			m.Data_ = map[string]int{"read": 1, "write": 2}
+			msg, err := createHekaMessage("", m, 1, "localhost", opts)
+			So(err, ShouldBeNil)
+			So(msg.FindFirstField("value.read"), ShouldNotBeNil)
+			So(msg.FindFirstField("value.write"), ShouldBeNil)
+		})
+	})
+}
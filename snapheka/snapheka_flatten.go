@@ -0,0 +1,212 @@
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2016 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package snapheka
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+// flattener expands the data of a metric into the fields of a message
+type flattener struct {
+	opts    fieldOptions
+	root    string // name of the field being flattened
+	rep     string
+	msg     *message.Message
+	added   int
+	dropped int
+}
+
+// addFlattened adds data to msg, expanding maps and structs into dotted
+// field names (value.read, value.write) and slices of scalars into multi
+// valued fields. Data nested deeper than flatten-max-depth is added as its
+// JSON text, and fields past flatten-max-fields are dropped and counted in
+// the dropped_fields field. Each field is filtered on both its own name
+// and the root name.
+func (opts fieldOptions) addFlattened(name string, v interface{}, rep string, msg *message.Message) error {
+	f := &flattener{opts: opts, root: name, rep: rep, msg: msg}
+	if err := f.add(name, v, 0); err != nil {
+		return err
+	}
+	if f.dropped == 0 {
+		return nil
+	}
+	logger.WithField("_block", "addFlattened").Warning(
+		fmt.Sprintf("Dropped %d fields of %s past flatten-max-fields=%d",
+			f.dropped, name, opts.flattenMaxFields))
+	if !opts.fieldFilter.allows("dropped_fields") {
+		return nil
+	}
+	return addField("dropped_fields", int64(f.dropped), msg)
+}
+
+func (f *flattener) add(name string, v interface{}, depth int) error {
+	if _, err := f.opts.convertValue(v); err == nil || v == nil || depth >= f.opts.flattenMaxDepth {
+		return f.leaf(name, v)
+	}
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr || rv.Kind() == reflect.Interface {
+		if rv.IsNil() {
+			return f.leaf(name, nil)
+		}
+		rv = rv.Elem()
+	}
+
+	switch rv.Kind() {
+	case reflect.Map:
+		keys := make([]string, 0, rv.Len())
+		values := make(map[string]reflect.Value, rv.Len())
+		for _, k := range rv.MapKeys() {
+			key := fmt.Sprint(k.Interface())
+			keys = append(keys, key)
+			values[key] = rv.MapIndex(k)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if err := f.add(name+"."+key, values[key].Interface(), depth+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	case reflect.Struct:
+		t := rv.Type()
+		n := 0
+		for i := 0; i < t.NumField(); i++ {
+			key, ok := structFieldName(t.Field(i))
+			if !ok {
+				continue
+			}
+			n++
+			if err := f.add(name+"."+key, rv.Field(i).Interface(), depth+1); err != nil {
+				return err
+			}
+		}
+		if n == 0 {
+			return f.leaf(name, rv.Interface())
+		}
+		return nil
+	case reflect.Slice, reflect.Array:
+		if values, ok := f.scalars(rv); ok {
+			if len(values) == 0 {
+				return nil
+			}
+			return f.multi(name, values)
+		}
+		for i := 0; i < rv.Len(); i++ {
+			if err := f.add(name+"."+strconv.Itoa(i), rv.Index(i).Interface(), depth+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return f.leaf(name, rv.Interface())
+	}
+}
+
+// structFieldName returns the field name of an exported struct field,
+// taken from its json tag when it has one
+func structFieldName(sf reflect.StructField) (string, bool) {
+	if len(sf.PkgPath) > 0 {
+		// unexported
+		return "", false
+	}
+	tag := strings.Split(sf.Tag.Get("json"), ",")[0]
+	if tag == "-" {
+		return "", false
+	}
+	if len(tag) > 0 {
+		return tag, true
+	}
+	return sf.Name, true
+}
+
+// scalars converts the elements of a slice into values of a single Heka
+// type, integers being promoted to doubles when mixed with them. ok is
+// false when an element is not a scalar or the types do not match.
+func (f *flattener) scalars(rv reflect.Value) (values []interface{}, ok bool) {
+	var kind reflect.Kind
+	mixed := false
+	for i := 0; i < rv.Len(); i++ {
+		value, err := f.opts.convertValue(rv.Index(i).Interface())
+		if err != nil {
+			return nil, false
+		}
+		k := reflect.TypeOf(value).Kind()
+		switch {
+		case i == 0 || k == kind:
+		case (k == reflect.Int64 && kind == reflect.Float64) || (k == reflect.Float64 && kind == reflect.Int64):
+			mixed = true
+		default:
+			return nil, false
+		}
+		if i == 0 {
+			kind = k
+		}
+		values = append(values, value)
+	}
+	if mixed {
+		for i, value := range values {
+			if n, isInt := value.(int64); isInt {
+				values[i] = float64(n)
+			}
+		}
+	}
+	return values, true
+}
+
+func (f *flattener) leaf(name string, v interface{}) error {
+	if !f.opts.fieldFilter.allowsNested(f.root, name) {
+		return nil
+	}
+	if f.added >= f.opts.flattenMaxFields {
+		f.dropped++
+		return nil
+	}
+	f.added++
+	return f.opts.addDataField(name, v, f.rep, f.msg)
+}
+
+// multi adds a multi valued field
+func (f *flattener) multi(name string, values []interface{}) error {
+	if !f.opts.fieldFilter.allowsNested(f.root, name) {
+		return nil
+	}
+	if f.added >= f.opts.flattenMaxFields {
+		f.dropped++
+		return nil
+	}
+	f.added++
+	field, err := message.NewField(name, values[0], f.rep)
+	if err != nil {
+		return fmt.Errorf("can not add field %s: %v", name, err)
+	}
+	for _, value := range values[1:] {
+		if err = field.AddValue(value); err != nil {
+			return fmt.Errorf("can not add field %s: %v", name, err)
+		}
+	}
+	f.msg.AddField(field)
+	return nil
+}
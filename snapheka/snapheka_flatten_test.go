@@ -0,0 +1,109 @@
+//
+// +build unit
+
+package snapheka
+
+import (
+	"testing"
+
+	"github.com/mozilla-services/heka/message"
+
+	"github.com/intelsdi-x/snap/core/ctypes"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type diskStats struct {
+	Read    uint64 `json:"read"`
+	Write   uint64
+	Ignored string `json:"-"`
+	private int
+}
+
+func TestFlatten(t *testing.T) {
+	Convey("Configure flattening", t, func() {
+		config := map[string]ctypes.ConfigValue{"flatten": ctypes.ConfigValueBool{Value: true}}
+
+		Convey("Flattening should be enabled with the defaults", func() {
+			opts, err := fieldOptionsFromConfig(config)
+			So(err, ShouldBeNil)
+			So(opts.flatten, ShouldBeTrue)
+			So(opts.flattenMaxDepth, ShouldEqual, dfltFlattenMaxDepth)
+			So(opts.flattenMaxFields, ShouldEqual, dfltFlattenMaxFields)
+		})
+		Convey("Limits below 1 should be rejected", func() {
+			config["flatten-max-depth"] = ctypes.ConfigValueInt{Value: 0}
+			_, err := fieldOptionsFromConfig(config)
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Flatten metric data into Heka fields", t, func() {
+		opts := newFieldOptions()
+		opts.flatten = true
+		msg := &message.Message{}
+
+		Convey("Maps should be expanded into dotted field names", func() {
+			data := map[string]interface{}{"read": uint64(3), "write": 4, "errors": map[string]int{"io": 1}}
+			So(opts.addValueField("value", data, "", msg), ShouldBeNil)
+			So(msg.FindFirstField("value"), ShouldBeNil)
+			So(msg.FindFirstField("value.read").GetValue(), ShouldEqual, int64(3))
+			So(msg.FindFirstField("value.write").GetValue(), ShouldEqual, int64(4))
+			So(msg.FindFirstField("value.errors.io").GetValue(), ShouldEqual, int64(1))
+		})
+		Convey("Structs should be expanded by exported field", func() {
+			So(opts.addValueField("value", &diskStats{Read: 1, Write: 2, Ignored: "x", private: 3}, "", msg), ShouldBeNil)
+			So(msg.FindFirstField("value.read").GetValue(), ShouldEqual, int64(1))
+			So(msg.FindFirstField("value.Write").GetValue(), ShouldEqual, int64(2))
+			So(len(msg.GetFields()), ShouldEqual, 2)
+		})
+		Convey("Slices of scalars should be multi valued fields", func() {
+			So(opts.addValueField("value", []int{1, 2, 3}, "", msg), ShouldBeNil)
+			So(msg.FindFirstField("value").GetValueInteger(), ShouldResemble, []int64{1, 2, 3})
+			So(opts.addValueField("mixed", []interface{}{1, 2.5}, "", msg), ShouldBeNil)
+			So(msg.FindFirstField("mixed").GetValueDouble(), ShouldResemble, []float64{1, 2.5})
+		})
+		Convey("Slices of structured data should be expanded by index", func() {
+			data := []map[string]string{{"name": "sda"}, {"name": "sdb"}}
+			So(opts.addValueField("value", data, "", msg), ShouldBeNil)
+			So(msg.FindFirstField("value.0.name").GetValue(), ShouldEqual, "sda")
+			So(msg.FindFirstField("value.1.name").GetValue(), ShouldEqual, "sdb")
+		})
+		Convey("Data deeper than the maximum depth should be sent as text", func() {
+			opts.flattenMaxDepth = 1
+			data := map[string]interface{}{"a": map[string]int{"b": 1}}
+			So(opts.addValueField("value", data, "", msg), ShouldBeNil)
+			So(msg.FindFirstField("value.a").GetValue(), ShouldEqual, `{"b":1}`)
+			So(msg.FindFirstField("unconverted_fields").GetValueString(), ShouldResemble, []string{"value.a"})
+		})
+		Convey("Fields past the maximum should be dropped and counted", func() {
+			opts.flattenMaxFields = 2
+			data := map[string]int{"a": 1, "b": 2, "c": 3, "d": 4}
+			So(opts.addValueField("value", data, "", msg), ShouldBeNil)
+			So(msg.FindFirstField("value.a"), ShouldNotBeNil)
+			So(msg.FindFirstField("value.b"), ShouldNotBeNil)
+			So(msg.FindFirstField("value.c"), ShouldBeNil)
+			So(msg.FindFirstField("dropped_fields").GetValue(), ShouldEqual, int64(2))
+		})
+		Convey("Flattened fields should be filtered on their own and root names", func() {
+			data := map[string]int{"read": 1, "write": 2, "errors": 3}
+			opts.fieldFilter = nameFilter{include: []string{"value.*"}, exclude: []string{"value.errors"}}
+			So(opts.addValueField("value", data, "", msg), ShouldBeNil)
+			So(msg.FindFirstField("value.read").GetValue(), ShouldEqual, int64(1))
+			So(msg.FindFirstField("value.write").GetValue(), ShouldEqual, int64(2))
+			So(msg.FindFirstField("value.errors"), ShouldBeNil)
+			opts.fieldFilter = nameFilter{include: []string{"value"}}
+			So(opts.addValueField("other", data, "", msg), ShouldBeNil)
+			So(opts.addValueField("value", []int{1, 2}, "", msg), ShouldBeNil)
+			So(msg.FindFirstField("other.read"), ShouldBeNil)
+			So(msg.FindFirstField("value").GetValueInteger(), ShouldResemble, []int64{1, 2})
+			opts.fieldFilter = nameFilter{exclude: []string{"value"}}
+			So(opts.addValueField("value", data, "", msg), ShouldBeNil)
+			So(len(msg.GetFields()), ShouldEqual, 3)
+		})
+		Convey("Scalars should be added as with flattening disabled", func() {
+			So(opts.addValueField("value", 1.5, "", msg), ShouldBeNil)
+			So(msg.FindFirstField("value").GetValue(), ShouldEqual, 1.5)
+		})
+	})
+}
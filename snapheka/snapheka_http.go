@@ -0,0 +1,282 @@
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2016 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package snapheka
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+	"github.com/pborman/uuid"
+
+	"github.com/intelsdi-x/snap/core/ctypes"
+)
+
+const (
+	// Formats of the HTTP request body
+	httpFormatProtobuf = "protobuf"
+	httpFormatJSON     = "json"
+
+	dfltHTTPPath   = "/"
+	dfltHTTPFormat = httpFormatProtobuf
+)
+
+// httpOptions are the settings of the http and https transports, which
+// POST batches of messages to a Heka HttpListenInput
+type httpOptions struct {
+	path     string
+	format   string
+	headers  map[string]string
+	gzip     bool
+	username string
+	password string
+}
+
+func newHTTPOptions() httpOptions {
+	return httpOptions{path: dfltHTTPPath, format: dfltHTTPFormat}
+}
+
+// httpOptionsFromConfig reads the HTTP transport settings of the task config
+func httpOptionsFromConfig(config map[string]ctypes.ConfigValue) (httpOptions, error) {
+	ho := newHTTPOptions()
+	ho.path = configString(config, "http-path", ho.path)
+	if !strings.HasPrefix(ho.path, "/") {
+		return ho, fmt.Errorf("http-path must start with '/', got '%s'", ho.path)
+	}
+	ho.format = configString(config, "http-format", ho.format)
+	if ho.format != httpFormatProtobuf && ho.format != httpFormatJSON {
+		return ho, fmt.Errorf("unknown http-format '%s' (should be %s or %s)",
+			ho.format, httpFormatProtobuf, httpFormatJSON)
+	}
+	if headers := configString(config, "http-headers", ""); len(headers) > 0 {
+		if err := json.Unmarshal([]byte(headers), &ho.headers); err != nil {
+			return ho, fmt.Errorf("http-headers must be a JSON object of strings: %v", err)
+		}
+	}
+	ho.gzip = configBool(config, "http-gzip", false)
+	ho.username = configString(config, "http-username", "")
+	password, set, err := configSecret(config, "http-password-file", "http-password-env")
+	if err != nil {
+		return ho, err
+	}
+	if set && len(ho.username) == 0 {
+		return ho, fmt.Errorf("http-username is required with http-password-file or http-password-env")
+	}
+	ho.password = password
+	return ho, nil
+}
+
+// HTTPStatusError is returned when Heka answers a POST with a status other
+// than 2xx. Requests failing with a 5xx status, 408 or 429 can be retried,
+// other statuses mean that the request itself is wrong.
+type HTTPStatusError struct {
+	URL        string
+	StatusCode int
+	Status     string
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("POST %s: %s", e.URL, e.Status)
+}
+
+// Temporary tells whether the request can be retried
+func (e *HTTPStatusError) Temporary() bool {
+	return e.StatusCode >= 500 || e.StatusCode == http.StatusRequestTimeout ||
+		e.StatusCode == http.StatusTooManyRequests
+}
+
+// isPermanent tells whether sending failed in a way that retrying the same
+// messages, or sending them to another endpoint, would not fix
+func isPermanent(err error) bool {
+	se, ok := err.(*HTTPStatusError)
+	return ok && !se.Temporary()
+}
+
+// isHTTP tells whether the client posts messages to an HttpListenInput
+func (shc *SnapHekaClient) isHTTP() bool {
+	return shc.hekaScheme == "http" || shc.hekaScheme == "https"
+}
+
+// httpTransport returns the HTTP client of the Heka client, created on
+// first use with the TLS settings and timeouts of the client. A whole POST,
+// including reading the response, is bounded by connect-timeout plus
+// write-timeout, unless one of them waits forever.
+func (shc *SnapHekaClient) httpTransport() *http.Client {
+	if shc.httpClient == nil {
+		dialer := &net.Dialer{Timeout: shc.connectTimeout}
+		var timeout time.Duration
+		if shc.connectTimeout > 0 && shc.writeTimeout > 0 {
+			timeout = shc.connectTimeout + shc.writeTimeout
+		}
+		shc.httpClient = &http.Client{
+			Timeout: timeout,
+			Transport: &http.Transport{
+				Proxy:                 http.ProxyFromEnvironment,
+				Dial:                  dialer.Dial,
+				TLSClientConfig:       shc.tlsConfig,
+				TLSHandshakeTimeout:   shc.connectTimeout,
+				ResponseHeaderTimeout: shc.writeTimeout,
+			},
+		}
+	}
+	return shc.httpClient
+}
+
+// closeHTTP closes the idle connections of the HTTP client
+func (shc *SnapHekaClient) closeHTTP() {
+	if shc.httpClient == nil {
+		return
+	}
+	if t, ok := shc.httpClient.Transport.(*http.Transport); ok {
+		t.CloseIdleConnections()
+	}
+}
+
+// postHTTP sends a batch of messages to a Heka HttpListenInput in one POST
+func (shc *SnapHekaClient) postHTTP(host string, buf []byte) error {
+	url := fmt.Sprintf("%s://%s%s", shc.hekaScheme, host, shc.http.path)
+	body := buf
+	if shc.http.gzip {
+		var gz bytes.Buffer
+		w := gzip.NewWriter(&gz)
+		w.Write(buf)
+		if err := w.Close(); err != nil {
+			return err
+		}
+		body = gz.Bytes()
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if shc.http.format == httpFormatJSON {
+		req.Header.Set("Content-Type", "application/x-ndjson")
+	} else {
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+	if shc.http.gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	for name, value := range shc.http.headers {
+		req.Header.Set(name, value)
+	}
+	if len(shc.http.username) > 0 {
+		req.SetBasicAuth(shc.http.username, shc.http.password)
+	}
+
+	hc := shc.httpTransport()
+	// http.Transport has no idle timeout before Go 1.7, connections unused
+	// for idleTimeout are closed here instead
+	now := time.Now()
+	if shc.idleTimeout > 0 && !shc.httpLastPost.IsZero() && now.Sub(shc.httpLastPost) >= shc.idleTimeout {
+		if t, ok := hc.Transport.(*http.Transport); ok {
+			t.CloseIdleConnections()
+		}
+	}
+	shc.httpLastPost = now
+	resp, err := hc.Do(req)
+	if isTimeout(err) {
+		return &TimeoutError{Op: "POST", Addr: url, Duration: shc.writeTimeout}
+	}
+	if err != nil {
+		return err
+	}
+	// the body is read so that the connection can be reused
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &HTTPStatusError{URL: url, StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	return nil
+}
+
+// jsonMessage is the JSON representation of a Heka message
+type jsonMessage struct {
+	UUID       string                 `json:"uuid"`
+	Timestamp  int64                  `json:"timestamp"`
+	Type       string                 `json:"type"`
+	Logger     string                 `json:"logger"`
+	Severity   int32                  `json:"severity"`
+	Payload    string                 `json:"payload"`
+	EnvVersion string                 `json:"env_version,omitempty"`
+	Pid        int32                  `json:"pid"`
+	Hostname   string                 `json:"hostname"`
+	Fields     map[string]interface{} `json:"fields"`
+}
+
+// encodeJSON returns a Heka message as a line of JSON. Fields with a single
+// value are written as that value and the other ones as an array.
+func encodeJSON(msg *message.Message) ([]byte, error) {
+	jm := jsonMessage{
+		UUID:       uuid.UUID(msg.GetUuid()).String(),
+		Timestamp:  msg.GetTimestamp(),
+		Type:       msg.GetType(),
+		Logger:     msg.GetLogger(),
+		Severity:   msg.GetSeverity(),
+		Payload:    msg.GetPayload(),
+		EnvVersion: msg.GetEnvVersion(),
+		Pid:        msg.GetPid(),
+		Hostname:   msg.GetHostname(),
+		Fields:     make(map[string]interface{}),
+	}
+	for _, f := range msg.GetFields() {
+		var values []interface{}
+		switch f.GetValueType() {
+		case message.Field_STRING:
+			for _, v := range f.GetValueString() {
+				values = append(values, v)
+			}
+		case message.Field_BYTES:
+			for _, v := range f.GetValueBytes() {
+				values = append(values, v)
+			}
+		case message.Field_INTEGER:
+			for _, v := range f.GetValueInteger() {
+				values = append(values, v)
+			}
+		case message.Field_DOUBLE:
+			for _, v := range f.GetValueDouble() {
+				values = append(values, v)
+			}
+		case message.Field_BOOL:
+			for _, v := range f.GetValueBool() {
+				values = append(values, v)
+			}
+		}
+		if len(values) == 1 {
+			jm.Fields[f.GetName()] = values[0]
+		} else {
+			jm.Fields[f.GetName()] = values
+		}
+	}
+	b, err := json.Marshal(jm)
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
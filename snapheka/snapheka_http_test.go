@@ -0,0 +1,308 @@
+//
+// +build unit
+
+package snapheka
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/intelsdi-x/snap/control/plugin"
+	"github.com/intelsdi-x/snap/core/ctypes"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// recordedRequest is a request received by the test HttpListenInput
+type recordedRequest struct {
+	header http.Header
+	path   string
+	body   []byte
+}
+
+// hekaHTTPServer records the requests it receives and answers them with
+// the given statuses, then with 200
+func hekaHTTPServer(tlsServer bool, statuses ...int) (*httptest.Server, func() []recordedRequest) {
+	var mutex sync.Mutex
+	var requests []recordedRequest
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mutex.Lock()
+		requests = append(requests, recordedRequest{r.Header, r.URL.Path, body})
+		status := http.StatusOK
+		if len(requests) <= len(statuses) {
+			status = statuses[len(requests)-1]
+		}
+		mutex.Unlock()
+		w.WriteHeader(status)
+	})
+	ts := httptest.NewUnstartedServer(handler)
+	if tlsServer {
+		ts.StartTLS()
+	} else {
+		ts.Start()
+	}
+	return ts, func() []recordedRequest {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return append([]recordedRequest(nil), requests...)
+	}
+}
+
+func newHTTPClient(url string) *SnapHekaClient {
+	shc, err := NewSnapHekaClient(url, "")
+	So(err, ShouldBeNil)
+	shc.retry = retryPolicy{maxAttempts: 3, backoff: time.Millisecond, maxBackoff: time.Millisecond}
+	return shc
+}
+
+func TestHekaHTTP(t *testing.T) {
+	Convey("Configure the HTTP transport", t, func() {
+		config := map[string]ctypes.ConfigValue{}
+
+		Convey("Defaults should be used when not set", func() {
+			ho, err := httpOptionsFromConfig(config)
+			So(err, ShouldBeNil)
+			So(ho, ShouldResemble, newHTTPOptions())
+		})
+		Convey("Options should be applied", func() {
+			config["http-path"] = ctypes.ConfigValueStr{Value: "/heka"}
+			config["http-format"] = ctypes.ConfigValueStr{Value: "json"}
+			config["http-headers"] = ctypes.ConfigValueStr{Value: `{"X-Token": "abc"}`}
+			config["http-gzip"] = ctypes.ConfigValueBool{Value: true}
+			config["http-username"] = ctypes.ConfigValueStr{Value: "snap"}
+			config["http-password-env"] = ctypes.ConfigValueStr{Value: "SNAPHEKA_TEST_HTTP_PASSWORD"}
+			ho, err := httpOptionsFromConfig(config)
+			So(err, ShouldBeNil)
+			So(ho.path, ShouldEqual, "/heka")
+			So(ho.format, ShouldEqual, httpFormatJSON)
+			So(ho.headers, ShouldResemble, map[string]string{"X-Token": "abc"})
+			So(ho.gzip, ShouldBeTrue)
+			So(ho.username, ShouldEqual, "snap")
+		})
+		Convey("Invalid options should be rejected", func() {
+			config["http-path"] = ctypes.ConfigValueStr{Value: "heka"}
+			_, err := httpOptionsFromConfig(config)
+			So(err, ShouldNotBeNil)
+			config["http-path"] = ctypes.ConfigValueStr{Value: "/"}
+			config["http-format"] = ctypes.ConfigValueStr{Value: "xml"}
+			_, err = httpOptionsFromConfig(config)
+			So(err, ShouldNotBeNil)
+			config["http-format"] = ctypes.ConfigValueStr{Value: "json"}
+			config["http-headers"] = ctypes.ConfigValueStr{Value: "X-Token: abc"}
+			_, err = httpOptionsFromConfig(config)
+			So(err, ShouldNotBeNil)
+			delete(config, "http-headers")
+			config["http-password-env"] = ctypes.ConfigValueStr{Value: "SNAPHEKA_TEST_HTTP_PASSWORD"}
+			_, err = httpOptionsFromConfig(config)
+			So(err, ShouldNotBeNil)
+		})
+		Convey("protocol http should give an http address", func() {
+			config["host"] = ctypes.ConfigValueStr{Value: "heka"}
+			config["port"] = ctypes.ConfigValueInt{Value: 8325}
+			config["protocol"] = ctypes.ConfigValueStr{Value: "http"}
+			addr, err := hekaAddress(config, false)
+			So(err, ShouldBeNil)
+			So(addr, ShouldEqual, "http://heka:8325")
+			addr, err = hekaAddress(config, true)
+			So(err, ShouldBeNil)
+			So(addr, ShouldEqual, "https://heka:8325")
+		})
+	})
+
+	Convey("Post metrics to an HttpListenInput", t, func() {
+		Convey("A batch of framed messages should be posted at once", func() {
+			ts, requests := hekaHTTPServer(false)
+			defer ts.Close()
+			shc := newHTTPClient(ts.URL)
+			shc.http.path = "/heka"
+			shc.http.headers = map[string]string{"X-Token": "abc"}
+			shc.http.username = "snap"
+			shc.http.password = "secret"
+			So(shc.sendToHeka(mockMetrics(10)), ShouldBeNil)
+			reqs := requests()
+			So(len(reqs), ShouldEqual, 1)
+			So(reqs[0].path, ShouldEqual, "/heka")
+			So(reqs[0].header.Get("Content-Type"), ShouldEqual, "application/octet-stream")
+			So(reqs[0].header.Get("X-Token"), ShouldEqual, "abc")
+			So(reqs[0].header.Get("Authorization"), ShouldEqual, "Basic c25hcDpzZWNyZXQ=")
+			n, err := countFrames(reqs[0].body)
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 10)
+		})
+		Convey("The body should be compressed with gzip", func() {
+			ts, requests := hekaHTTPServer(false)
+			defer ts.Close()
+			shc := newHTTPClient(ts.URL)
+			shc.http.gzip = true
+			So(shc.sendToHeka(mockMetrics(3)), ShouldBeNil)
+			reqs := requests()
+			So(len(reqs), ShouldEqual, 1)
+			So(reqs[0].header.Get("Content-Encoding"), ShouldEqual, "gzip")
+			r, err := gzip.NewReader(bytes.NewReader(reqs[0].body))
+			So(err, ShouldBeNil)
+			body, err := ioutil.ReadAll(r)
+			So(err, ShouldBeNil)
+			n, err := countFrames(body)
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 3)
+		})
+		Convey("The body should hold one JSON message per line", func() {
+			ts, requests := hekaHTTPServer(false)
+			defer ts.Close()
+			shc := newHTTPClient(ts.URL)
+			shc.http.format = httpFormatJSON
+			So(shc.sendToHeka(mockMetrics(3)), ShouldBeNil)
+			reqs := requests()
+			So(len(reqs), ShouldEqual, 1)
+			So(reqs[0].header.Get("Content-Type"), ShouldEqual, "application/x-ndjson")
+			scanner := bufio.NewScanner(bytes.NewReader(reqs[0].body))
+			lines := 0
+			for scanner.Scan() {
+				var jm jsonMessage
+				So(json.Unmarshal(scanner.Bytes(), &jm), ShouldBeNil)
+				So(jm.Type, ShouldEqual, SnapHekaMsgType)
+				So(jm.Fields["name"], ShouldEqual, fmt.Sprintf("intel.mock.metric%d", lines))
+				So(jm.Fields["value"], ShouldEqual, float64(lines))
+				lines++
+			}
+			So(lines, ShouldEqual, 3)
+		})
+		Convey("Messages which can not be encoded as JSON should be rejected", func() {
+			ts, requests := hekaHTTPServer(false)
+			defer ts.Close()
+			shc := newHTTPClient(ts.URL)
+			shc.http.format = httpFormatJSON
+			shc.payload.format = payloadNone
+			metrics := mockMetrics(2)
+			metrics[0] = *plugin.NewMetricType(metrics[0].Namespace(), time.Now(), nil, "", math.NaN())
+			err := shc.sendToHeka(metrics)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "1 of 2 messages were rejected")
+			reqs := requests()
+			So(len(reqs), ShouldEqual, 1)
+			So(bytes.Count(reqs[0].body, []byte("\n")), ShouldEqual, 1)
+		})
+		Convey("A 5xx status should be retried", func() {
+			ts, requests := hekaHTTPServer(false, http.StatusServiceUnavailable)
+			defer ts.Close()
+			shc := newHTTPClient(ts.URL)
+			So(shc.sendToHeka(mockMetrics(1)), ShouldBeNil)
+			So(len(requests()), ShouldEqual, 2)
+		})
+		Convey("A 4xx status should not be retried nor spooled", func() {
+			ts, requests := hekaHTTPServer(false, http.StatusBadRequest)
+			defer ts.Close()
+			dir, err := ioutil.TempDir("", "snapheka-spool")
+			So(err, ShouldBeNil)
+			defer os.RemoveAll(dir)
+			shc := newHTTPClient(ts.URL)
+			shc.spool, err = newSpool(dir, dfltSpoolMaxBytes, dfltSpoolSegmentBytes, 0, fsyncNever)
+			So(err, ShouldBeNil)
+			err = shc.sendToHeka(mockMetrics(1))
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "400 Bad Request")
+			So(err.Error(), ShouldContainSubstring, "after 1 attempts")
+			So(len(requests()), ShouldEqual, 1)
+			So(shc.spool.empty(), ShouldBeTrue)
+		})
+		Convey("Messages should be posted over https", func() {
+			ts, requests := hekaHTTPServer(true)
+			defer ts.Close()
+			So(strings.HasPrefix(ts.URL, "https://"), ShouldBeTrue)
+			shc := newHTTPClient(ts.URL)
+			shc.tlsConfig = &tls.Config{InsecureSkipVerify: true}
+			So(shc.sendToHeka(mockMetrics(1)), ShouldBeNil)
+			So(len(requests()), ShouldEqual, 1)
+		})
+		Convey("Connections idle for longer than the idle timeout should be closed", func() {
+			ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			var mutex sync.Mutex
+			conns := 0
+			ts.Config.ConnState = func(c net.Conn, state http.ConnState) {
+				if state == http.StateNew {
+					mutex.Lock()
+					conns++
+					mutex.Unlock()
+				}
+			}
+			ts.Start()
+			defer ts.Close()
+			newConns := func() int {
+				mutex.Lock()
+				defer mutex.Unlock()
+				return conns
+			}
+			shc := newHTTPClient(ts.URL)
+			shc.idleTimeout = time.Hour
+			So(shc.sendToHeka(mockMetrics(1)), ShouldBeNil)
+			So(shc.sendToHeka(mockMetrics(1)), ShouldBeNil)
+			So(newConns(), ShouldEqual, 1)
+			shc.idleTimeout = 10 * time.Millisecond
+			time.Sleep(20 * time.Millisecond)
+			So(shc.sendToHeka(mockMetrics(1)), ShouldBeNil)
+			So(newConns(), ShouldEqual, 2)
+		})
+		Convey("A POST should be bounded by the connect and write timeouts", func() {
+			release := make(chan struct{})
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				// sends the headers and stalls on the body
+				w.WriteHeader(http.StatusOK)
+				w.(http.Flusher).Flush()
+				<-release
+			}))
+			defer ts.Close()
+			defer close(release)
+			shc := newHTTPClient(ts.URL)
+			shc.connectTimeout = 20 * time.Millisecond
+			shc.writeTimeout = 20 * time.Millisecond
+			So(shc.httpTransport().Timeout, ShouldEqual, 40*time.Millisecond)
+			done := make(chan error, 1)
+			go func() { done <- shc.sendToHeka(mockMetrics(1)) }()
+			select {
+			case err := <-done:
+				So(err, ShouldBeNil)
+			case <-time.After(5 * time.Second):
+				So("sendToHeka did not return", ShouldBeEmpty)
+			}
+		})
+		Convey("A POST should not be bounded when a timeout waits forever", func() {
+			shc := newHTTPClient("http://127.0.0.1:1")
+			shc.writeTimeout = 0
+			So(shc.httpTransport().Timeout, ShouldEqual, 0)
+		})
+		Convey("Closing the client should close its idle connections", func() {
+			closed := make(chan struct{}, 1)
+			ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			ts.Config.ConnState = func(c net.Conn, state http.ConnState) {
+				if state == http.StateClosed {
+					closed <- struct{}{}
+				}
+			}
+			ts.Start()
+			defer ts.Close()
+			shc := newHTTPClient(ts.URL)
+			So(shc.sendToHeka(mockMetrics(1)), ShouldBeNil)
+			shc.close()
+			select {
+			case <-closed:
+			case <-time.After(5 * time.Second):
+				So("the connection was not closed", ShouldBeEmpty)
+			}
+		})
+	})
+}
@@ -0,0 +1,219 @@
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2016 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package snapheka
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/intelsdi-x/snap/core/ctypes"
+)
+
+const (
+	// What to do with messages over the rate limits
+	throttleDelay = "delay"
+	throttleDrop  = "drop"
+
+	dfltRateLimitMode = throttleDelay
+)
+
+// tokenBucket holds up to one second worth of tokens, refilled at rate
+// tokens per second. Taking more tokens than available leaves a debt
+// which delays the following requests.
+type tokenBucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int, now time.Time) *tokenBucket {
+	return &tokenBucket{rate: float64(rate), tokens: float64(rate), last: now}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = math.Min(b.rate, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// delay returns how long to wait before n tokens can be taken. A request
+// larger than the bucket only waits for the bucket to be full.
+func (b *tokenBucket) delay(n float64) time.Duration {
+	need := math.Min(n, b.rate)
+	if b.tokens >= need {
+		return 0
+	}
+	return time.Duration((need - b.tokens) / b.rate * float64(time.Second))
+}
+
+// rateLimiter limits the messages and bytes sent to Heka per second.
+// Its buckets are used by the goroutine sending the messages of a client
+// only, the counters may also be read by other goroutines.
+type rateLimiter struct {
+	// nil when there is no limit
+	messages *tokenBucket
+	bytes    *tokenBucket
+	mode     string
+	// Number of messages delayed and dropped so far
+	mutex   sync.Mutex
+	delayed uint64
+	dropped uint64
+	now     func() time.Time
+	sleep   func(time.Duration)
+}
+
+// rateLimiterFromConfig builds the rate limiter of the task config. It
+// returns nil when neither rate-limit-messages nor rate-limit-bytes is set.
+func rateLimiterFromConfig(config map[string]ctypes.ConfigValue) (*rateLimiter, error) {
+	return newRateLimiter(
+		configInt(config, "rate-limit-messages", 0),
+		configInt(config, "rate-limit-bytes", 0),
+		configString(config, "rate-limit-mode", dfltRateLimitMode))
+}
+
+func newRateLimiter(messages, bytes int, mode string) (*rateLimiter, error) {
+	if messages < 0 || bytes < 0 {
+		return nil, fmt.Errorf("rate-limit-messages and rate-limit-bytes must not be negative")
+	}
+	if mode != throttleDelay && mode != throttleDrop {
+		return nil, fmt.Errorf("unknown rate-limit-mode '%s' (should be %s or %s)",
+			mode, throttleDelay, throttleDrop)
+	}
+	if messages == 0 && bytes == 0 {
+		return nil, nil
+	}
+	l := &rateLimiter{mode: mode, now: time.Now, sleep: time.Sleep}
+	now := l.now()
+	if messages > 0 {
+		l.messages = newTokenBucket(messages, now)
+	}
+	if bytes > 0 {
+		l.bytes = newTokenBucket(bytes, now)
+	}
+	return l, nil
+}
+
+// reserve refills the buckets and returns how long to wait before msgs
+// messages of size bytes in total can be sent
+func (l *rateLimiter) reserve(msgs, size int) time.Duration {
+	now := l.now()
+	var d time.Duration
+	if l.messages != nil {
+		l.messages.refill(now)
+		d = l.messages.delay(float64(msgs))
+	}
+	if l.bytes != nil {
+		l.bytes.refill(now)
+		if bd := l.bytes.delay(float64(size)); bd > d {
+			d = bd
+		}
+	}
+	return d
+}
+
+func (l *rateLimiter) take(msgs, size int) {
+	if l.messages != nil {
+		l.messages.tokens -= float64(msgs)
+	}
+	if l.bytes != nil {
+		l.bytes.tokens -= float64(size)
+	}
+}
+
+// allow tells whether a message of size bytes is within the limits,
+// counting it as dropped otherwise
+func (l *rateLimiter) allow(size int) bool {
+	if l.reserve(1, size) > 0 {
+		l.mutex.Lock()
+		l.dropped++
+		l.mutex.Unlock()
+		return false
+	}
+	l.take(1, size)
+	return true
+}
+
+// wait blocks until msgs messages of size bytes in total can be sent
+func (l *rateLimiter) wait(msgs, size int) {
+	if d := l.reserve(msgs, size); d > 0 {
+		l.mutex.Lock()
+		l.delayed += uint64(msgs)
+		delayed, dropped := l.delayed, l.dropped
+		l.mutex.Unlock()
+		logger.WithField("_block", "rateLimiter").Debug(
+			fmt.Sprintf("Rate limit reached, delaying %d messages by %v (throttled delayed=%d dropped=%d)",
+				msgs, d, delayed, dropped))
+		l.sleep(d)
+		l.reserve(msgs, size)
+	}
+	l.take(msgs, size)
+}
+
+// batchLimits lowers the limits of a batch of messages to the size of the
+// buckets, so that a batch is never sent faster than the rates. A single
+// message larger than the byte bucket still makes a batch on its own.
+func (l *rateLimiter) batchLimits(maxMessages, maxBytes int) (int, int) {
+	if l.messages != nil && int(l.messages.rate) < maxMessages {
+		maxMessages = int(l.messages.rate)
+	}
+	if l.bytes != nil && int(l.bytes.rate) < maxBytes {
+		maxBytes = int(l.bytes.rate)
+	}
+	return maxMessages, maxBytes
+}
+
+// stats returns the number of messages delayed and dropped so far
+func (l *rateLimiter) stats() (delayed, dropped uint64) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.delayed, l.dropped
+}
+
+// ThrottleStats returns the number of messages delayed and dropped so far
+// because of the rate limits. Both are zero when there is no rate limit.
+func (shc *SnapHekaClient) ThrottleStats() (delayed, dropped uint64) {
+	if shc.limiter == nil {
+		return 0, 0
+	}
+	return shc.limiter.stats()
+}
+
+// throttle drops the messages over the rate limits when the limiter is in
+// drop mode. In delay mode, messages are held back when written instead.
+func (shc *SnapHekaClient) throttle(frames []hekaFrame) []hekaFrame {
+	if shc.limiter == nil || shc.limiter.mode != throttleDrop {
+		return frames
+	}
+	kept := frames[:0]
+	for _, f := range frames {
+		if shc.limiter.allow(len(f.buf)) {
+			kept = append(kept, f)
+		}
+	}
+	if n := len(frames) - len(kept); n > 0 {
+		delayed, dropped := shc.limiter.stats()
+		logger.WithField("_block", "throttle").Warning(
+			fmt.Sprintf("Rate limit exceeded, dropped %d of %d messages (throttled delayed=%d dropped=%d)",
+				n, len(frames), delayed, dropped))
+	}
+	return kept
+}
@@ -0,0 +1,152 @@
+//
+// +build unit
+
+package snapheka
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/intelsdi-x/snap/core/ctypes"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// fakeClock drives the time of a rate limiter, sleeping moves it forward
+type fakeClock struct {
+	t     time.Time
+	slept time.Duration
+}
+
+func (c *fakeClock) now() time.Time { return c.t }
+
+func (c *fakeClock) sleep(d time.Duration) {
+	c.slept += d
+	c.t = c.t.Add(d)
+}
+
+func newFakeLimiter(messages, bytes int, mode string) (*rateLimiter, *fakeClock) {
+	l, err := newRateLimiter(messages, bytes, mode)
+	if err != nil {
+		panic(err)
+	}
+	clock := &fakeClock{t: time.Now()}
+	l.now = clock.now
+	l.sleep = clock.sleep
+	return l, clock
+}
+
+func TestRateLimiter(t *testing.T) {
+	Convey("Create a rate limiter", t, func() {
+		Convey("No limiter should be created without limits", func() {
+			l, err := rateLimiterFromConfig(map[string]ctypes.ConfigValue{})
+			So(err, ShouldBeNil)
+			So(l, ShouldBeNil)
+		})
+		Convey("Invalid settings should be rejected", func() {
+			_, err := newRateLimiter(-1, 0, throttleDelay)
+			So(err, ShouldNotBeNil)
+			_, err = newRateLimiter(10, 0, "queue")
+			So(err, ShouldNotBeNil)
+		})
+		Convey("Messages over the message rate should be dropped", func() {
+			l, clock := newFakeLimiter(5, 0, throttleDrop)
+			for i := 0; i < 5; i++ {
+				So(l.allow(100), ShouldBeTrue)
+			}
+			So(l.allow(100), ShouldBeFalse)
+			clock.t = clock.t.Add(200 * time.Millisecond)
+			So(l.allow(100), ShouldBeTrue)
+			So(l.allow(100), ShouldBeFalse)
+			delayed, dropped := l.stats()
+			So(delayed, ShouldEqual, 0)
+			So(dropped, ShouldEqual, 2)
+		})
+		Convey("Messages over the byte rate should be dropped", func() {
+			l, clock := newFakeLimiter(0, 100, throttleDrop)
+			So(l.allow(60), ShouldBeTrue)
+			So(l.allow(60), ShouldBeFalse)
+			clock.t = clock.t.Add(200 * time.Millisecond)
+			So(l.allow(60), ShouldBeTrue)
+		})
+		Convey("A message larger than the byte rate should wait for a full bucket", func() {
+			l, clock := newFakeLimiter(0, 100, throttleDelay)
+			l.wait(1, 500)
+			So(clock.slept, ShouldEqual, 0)
+			l.wait(1, 50)
+			So(clock.slept, ShouldEqual, 4500*time.Millisecond)
+		})
+		Convey("Messages over the rate should be delayed", func() {
+			l, clock := newFakeLimiter(5, 0, throttleDelay)
+			l.wait(5, 500)
+			So(clock.slept, ShouldEqual, 0)
+			l.wait(5, 500)
+			So(clock.slept, ShouldEqual, time.Second)
+			delayed, dropped := l.stats()
+			So(delayed, ShouldEqual, 5)
+			So(dropped, ShouldEqual, 0)
+		})
+		Convey("Batches should not be larger than the buckets", func() {
+			l, _ := newFakeLimiter(5, 1000, throttleDelay)
+			maxMessages, maxBytes := l.batchLimits(100, 65536)
+			So(maxMessages, ShouldEqual, 5)
+			So(maxBytes, ShouldEqual, 1000)
+			l, _ = newFakeLimiter(0, 100000, throttleDelay)
+			maxMessages, maxBytes = l.batchLimits(100, 65536)
+			So(maxMessages, ShouldEqual, 100)
+			So(maxBytes, ShouldEqual, 65536)
+		})
+	})
+}
+
+func TestHekaRateLimit(t *testing.T) {
+	defer hekaConns.closeAll()
+
+	Convey("Send metrics with a rate limit", t, func() {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		defer l.Close()
+		received := readAll(l)
+		shc, err := NewSnapHekaClient("tcp://"+l.Addr().String(), "")
+		So(err, ShouldBeNil)
+
+		Convey("Messages over the limit should be dropped in drop mode", func() {
+			delayed, dropped := shc.ThrottleStats()
+			So(delayed+dropped, ShouldEqual, 0)
+			shc.limiter, _ = newFakeLimiter(3, 0, throttleDrop)
+			So(shc.sendToHeka(mockMetrics(10)), ShouldBeNil)
+			_, dropped = shc.ThrottleStats()
+			So(dropped, ShouldEqual, 7)
+			hekaConns.closeAll()
+			n, err := countFrames(<-received)
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 3)
+		})
+		Convey("Writes should be paced in delay mode", func() {
+			var clock *fakeClock
+			shc.limiter, clock = newFakeLimiter(5, 0, throttleDelay)
+			shc.batchMaxMessages = 5
+			So(shc.sendToHeka(mockMetrics(15)), ShouldBeNil)
+			So(clock.slept, ShouldEqual, 2*time.Second)
+			hekaConns.closeAll()
+			n, err := countFrames(<-received)
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 15)
+		})
+		Convey("Batches should be split to the rate in delay mode", func() {
+			var clock *fakeClock
+			shc.limiter, clock = newFakeLimiter(5, 0, throttleDelay)
+			shc.batchMaxMessages = 100
+			So(shc.sendToHeka(mockMetrics(15)), ShouldBeNil)
+			So(clock.slept, ShouldEqual, 2*time.Second)
+			delayed, dropped := shc.ThrottleStats()
+			So(delayed, ShouldEqual, 10)
+			So(dropped, ShouldEqual, 0)
+			hekaConns.closeAll()
+			n, err := countFrames(<-received)
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 15)
+		})
+	})
+}
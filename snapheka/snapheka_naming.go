@@ -0,0 +1,160 @@
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2016 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package snapheka
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/intelsdi-x/snap/control/plugin"
+)
+
+const (
+	// What to do with tags and dynamic elements named like a reserved field
+	collisionRename = "rename"
+	collisionDrop   = "drop"
+	collisionReject = "reject"
+
+	// Which of a tag and a dynamic element with the same field name is kept
+	overrideDimension = "dimension"
+	overrideTag       = "tag"
+
+	dfltReservedCollision = collisionRename
+	dfltFieldOverride     = overrideDimension
+)
+
+// reservedFields are the names of the fields always set by the plugin
+// itself
+var reservedFields = map[string]bool{
+	"name":               true,
+	"value":              true,
+	"timestamp":          true,
+	"dimensions":         true,
+	"unconverted_fields": true,
+}
+
+// dimension is a field made of a dynamic namespace element or a tag
+type dimension struct {
+	field string
+	value string
+	tag   bool
+}
+
+// hasDimension tells whether one of dims is the field name
+func hasDimension(dims []dimension, field string) bool {
+	for _, d := range dims {
+		if d.field == field {
+			return true
+		}
+	}
+	return false
+}
+
+// reserved tells whether a field name is the name of a field set by the
+// plugin with the enabled options, including the fields the value is
+// flattened into
+func (opts fieldOptions) reserved(field string) bool {
+	switch field {
+	case "unit":
+		return opts.unitField
+	case "description":
+		return opts.descriptionField
+	case "metric_version":
+		return opts.versionField
+	case "publish_timestamp":
+		return opts.publishTimestamp
+	case "dropped_fields":
+		return opts.flatten
+	}
+	return reservedFields[field] || (opts.flatten && strings.HasPrefix(field, "value."))
+}
+
+// dimensionFields returns the fields of the dynamic namespace elements of m
+// followed by the fields of its tags sorted by name, leaving out those
+// which do not pass the dimension and tag filters. Field names are
+// prefixed with dimension-prefix or tag-prefix, names colliding with a
+// reserved field are handled with reserved-collision and a tag named like a
+// dynamic element either replaces its value or is left out, depending on
+// field-override. A field renamed into the name of another one is left
+// out.
+func (opts fieldOptions) dimensionFields(m plugin.MetricType) ([]dimension, error) {
+	var candidates []dimension
+	for _, elt := range m.Namespace() {
+		if elt.IsDynamic() && opts.dimensionFilter.allows(elt.Name) {
+			candidates = append(candidates, dimension{opts.dimensionPrefix + elt.Name, elt.Value, false})
+		}
+	}
+	tags := m.Tags()
+	for _, tag := range sortedKeys(tags) {
+		if !opts.tagFilter.allows(tag) {
+			continue
+		}
+		candidates = append(candidates, dimension{opts.tagPrefix + tag, tags[tag], true})
+	}
+
+	dims := make([]dimension, 0, len(candidates))
+	index := make(map[string]int, len(candidates))
+	// fields named by reserved-collision rename
+	renamed := make(map[string]bool)
+	for _, d := range candidates {
+		rename := false
+		if opts.reserved(d.field) {
+			switch opts.reservedCollision {
+			case collisionDrop:
+				logger.WithField("_block", "dimensionFields").Debug(
+					fmt.Sprintf("Dropping %s, reserved field name", d.field))
+				continue
+			case collisionReject:
+				return nil, fmt.Errorf("metric %s: %s is a reserved field name", namespaceString(m), d.field)
+			default:
+				if d.tag {
+					d.field = "tag_" + d.field
+				} else {
+					d.field = "dimension_" + d.field
+				}
+				rename = true
+			}
+		}
+		if i, ok := index[d.field]; ok {
+			switch {
+			case rename || renamed[d.field]:
+				// the field which was not renamed is kept
+				logger.WithField("_block", "dimensionFields").Warning(
+					fmt.Sprintf("Metric %s: %s renamed from a reserved field name collides with another field, leaving it out",
+						namespaceString(m), d.field))
+				if !rename {
+					dims[i] = d
+					renamed[d.field] = false
+				}
+			default:
+				logger.WithField("_block", "dimensionFields").Debug(
+					fmt.Sprintf("Duplicate field %s", d.field))
+				if d.tag && !dims[i].tag && opts.fieldOverride == overrideTag {
+					dims[i] = d
+				}
+			}
+			continue
+		}
+		index[d.field] = len(dims)
+		renamed[d.field] = rename
+		dims = append(dims, d)
+	}
+	return dims, nil
+}
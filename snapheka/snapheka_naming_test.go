@@ -0,0 +1,124 @@
+//
+// +build unit
+
+package snapheka
+
+import (
+	"testing"
+
+	"github.com/intelsdi-x/snap/core/ctypes"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func fieldNames(dims []dimension) []string {
+	names := make([]string, 0, len(dims))
+	for _, d := range dims {
+		names = append(names, d.field+"="+d.value)
+	}
+	return names
+}
+
+func TestFieldNaming(t *testing.T) {
+	Convey("Configure the field naming", t, func() {
+		config := map[string]ctypes.ConfigValue{}
+
+		Convey("Invalid policies should be rejected", func() {
+			config["reserved-collision"] = ctypes.ConfigValueStr{Value: "overwrite"}
+			_, err := fieldOptionsFromConfig(config)
+			So(err, ShouldNotBeNil)
+			config["reserved-collision"] = ctypes.ConfigValueStr{Value: collisionDrop}
+			config["field-override"] = ctypes.ConfigValueStr{Value: "both"}
+			_, err = fieldOptionsFromConfig(config)
+			So(err, ShouldNotBeNil)
+		})
+		Convey("Prefixes should be read", func() {
+			config["tag-prefix"] = ctypes.ConfigValueStr{Value: "tag."}
+			config["dimension-prefix"] = ctypes.ConfigValueStr{Value: "ns."}
+			opts, err := fieldOptionsFromConfig(config)
+			So(err, ShouldBeNil)
+			So(opts.tagPrefix, ShouldEqual, "tag.")
+			So(opts.dimensionPrefix, ShouldEqual, "ns.")
+		})
+	})
+
+	Convey("Name the fields of dynamic elements and tags", t, func() {
+		opts := newFieldOptions()
+
+		Convey("Dynamic elements should come first and tags sorted by name", func() {
+			dims, err := opts.dimensionFields(dynamicMetric("host", "dyn", map[string]string{"b": "2", "a": "1"}, 1))
+			So(err, ShouldBeNil)
+			So(fieldNames(dims), ShouldResemble, []string{"host=dyn", "a=1", "b=2"})
+		})
+		Convey("Prefixes should be added", func() {
+			opts.tagPrefix = "tag."
+			opts.dimensionPrefix = "ns."
+			dims, err := opts.dimensionFields(dynamicMetric("host", "dyn", map[string]string{"host": "h"}, 1))
+			So(err, ShouldBeNil)
+			So(fieldNames(dims), ShouldResemble, []string{"ns.host=dyn", "tag.host=h"})
+		})
+		Convey("Reserved names should be renamed by default", func() {
+			dims, err := opts.dimensionFields(dynamicMetric("value", "dyn", map[string]string{"timestamp": "t"}, 1))
+			So(err, ShouldBeNil)
+			So(fieldNames(dims), ShouldResemble, []string{"dimension_value=dyn", "tag_timestamp=t"})
+		})
+		Convey("Flattened value fields should be reserved", func() {
+			opts.flatten = true
+			dims, err := opts.dimensionFields(dynamicMetric("host", "dyn", map[string]string{"value.read": "r"}, 1))
+			So(err, ShouldBeNil)
+			So(fieldNames(dims), ShouldResemble, []string{"host=dyn", "tag_value.read=r"})
+		})
+		Convey("Names of optional fields should only be reserved when enabled", func() {
+			tags := map[string]string{"unit": "u", "publish_timestamp": "p", "dropped_fields": "d"}
+			dims, err := opts.dimensionFields(dynamicMetric("host", "dyn", tags, 1))
+			So(err, ShouldBeNil)
+			So(fieldNames(dims), ShouldResemble, []string{"host=dyn", "dropped_fields=d", "publish_timestamp=p", "unit=u"})
+			opts.unitField = true
+			opts.publishTimestamp = true
+			opts.flatten = true
+			dims, err = opts.dimensionFields(dynamicMetric("host", "dyn", tags, 1))
+			So(err, ShouldBeNil)
+			So(fieldNames(dims), ShouldResemble, []string{"host=dyn", "tag_dropped_fields=d", "tag_publish_timestamp=p", "tag_unit=u"})
+		})
+		Convey("publish_timestamp should be reserved with timestamp-source both", func() {
+			config := map[string]ctypes.ConfigValue{"timestamp-source": ctypes.ConfigValueStr{Value: tsSourceBoth}}
+			opts, err := fieldOptionsFromConfig(config)
+			So(err, ShouldBeNil)
+			So(opts.reserved("publish_timestamp"), ShouldBeTrue)
+		})
+		Convey("A renamed field should not replace a field with its new name", func() {
+			dims, err := opts.dimensionFields(dynamicMetric("host", "dyn", map[string]string{"name": "n", "tag_name": "t"}, 1))
+			So(err, ShouldBeNil)
+			So(fieldNames(dims), ShouldResemble, []string{"host=dyn", "tag_name=t"})
+			dims, err = opts.dimensionFields(dynamicMetric("tag_name", "dyn", map[string]string{"name": "n"}, 1))
+			So(err, ShouldBeNil)
+			So(fieldNames(dims), ShouldResemble, []string{"tag_name=dyn"})
+		})
+		Convey("Reserved names should be dropped or rejected when configured", func() {
+			opts.reservedCollision = collisionDrop
+			dims, err := opts.dimensionFields(dynamicMetric("host", "dyn", map[string]string{"name": "n"}, 1))
+			So(err, ShouldBeNil)
+			So(fieldNames(dims), ShouldResemble, []string{"host=dyn"})
+			opts.reservedCollision = collisionReject
+			_, err = opts.dimensionFields(dynamicMetric("host", "dyn", map[string]string{"name": "n"}, 1))
+			So(err, ShouldNotBeNil)
+		})
+		Convey("A tag named like a dynamic element should follow the override order", func() {
+			m := dynamicMetric("host", "dyn", map[string]string{"host": "tagged"}, 1)
+			dims, err := opts.dimensionFields(m)
+			So(err, ShouldBeNil)
+			So(fieldNames(dims), ShouldResemble, []string{"host=dyn"})
+			opts.fieldOverride = overrideTag
+			dims, err = opts.dimensionFields(m)
+			So(err, ShouldBeNil)
+			So(fieldNames(dims), ShouldResemble, []string{"host=tagged"})
+		})
+		Convey("The message should have no duplicate fields or dimensions", func() {
+			msg, err := createHekaMessage("", dynamicMetric("host", "dyn", map[string]string{"host": "h", "name": "n"}, 1), 1, "localhost", opts)
+			So(err, ShouldBeNil)
+			So(msg.FindFirstField("dimensions").GetValueString(), ShouldResemble, []string{"host", "tag_name"})
+			So(msg.FindFirstField("name").GetValue(), ShouldEqual, "intel.mock.load")
+			So(len(msg.GetFields()), ShouldEqual, 6)
+		})
+	})
+}
@@ -0,0 +1,171 @@
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2016 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package snapheka
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/intelsdi-x/snap/control/plugin"
+	"github.com/intelsdi-x/snap/core/ctypes"
+)
+
+const (
+	// Sources of the Hostname and Pid of the messages
+	sourceTag       = "tag:"
+	sourceDimension = "dimension:"
+	sourceOS        = "os"
+
+	dfltHostnameSource = "hostname," + sourceOS
+	dfltPidSource      = "pid," + sourceOS
+)
+
+// originSource is a source of the Hostname or Pid of a message: a tag or
+// dynamic element of the metric, the fixed value from the task config or
+// the value of the snap host
+type originSource struct {
+	kind string
+	name string
+}
+
+// originPolicy chooses the Hostname and Pid of the message of each metric.
+// The sources of each chain are tried in order until one gives a value.
+type originPolicy struct {
+	hostnameChain []originSource
+	hostname      string
+	pidChain      []originSource
+	pid           int32
+	pidSet        bool
+}
+
+func newOriginPolicy() originPolicy {
+	op := originPolicy{}
+	op.hostnameChain, _ = parseOriginChain(dfltHostnameSource, "hostname")
+	op.pidChain, _ = parseOriginChain(dfltPidSource, "pid")
+	return op
+}
+
+// originPolicyFromConfig reads hostname, hostname-source, pid and
+// pid-source from the task config
+func originPolicyFromConfig(config map[string]ctypes.ConfigValue) (originPolicy, error) {
+	op := newOriginPolicy()
+	var err error
+	op.hostname = configString(config, "hostname", "")
+	if op.hostnameChain, err = parseOriginChain(configString(config, "hostname-source", dfltHostnameSource), "hostname"); err != nil {
+		return op, err
+	}
+	if v, ok := config["pid"].(ctypes.ConfigValueInt); ok {
+		if v.Value < 0 || v.Value > math.MaxInt32 {
+			return op, fmt.Errorf("pid must be between 0 and %d, got %d", math.MaxInt32, v.Value)
+		}
+		op.pid = int32(v.Value)
+		op.pidSet = true
+	}
+	if op.pidChain, err = parseOriginChain(configString(config, "pid-source", dfltPidSource), "pid"); err != nil {
+		return op, err
+	}
+	return op, nil
+}
+
+// parseOriginChain parses a comma separated list of sources: tag:<name>,
+// dimension:<name>, the name of the fixed value option or os
+func parseOriginChain(s string, fixed string) ([]originSource, error) {
+	var chain []originSource
+	for _, src := range strings.Split(s, ",") {
+		src = strings.TrimSpace(src)
+		switch {
+		case src == sourceOS || src == fixed:
+			chain = append(chain, originSource{kind: src})
+		case strings.HasPrefix(src, sourceTag) && len(src) > len(sourceTag):
+			chain = append(chain, originSource{sourceTag, strings.TrimPrefix(src, sourceTag)})
+		case strings.HasPrefix(src, sourceDimension) && len(src) > len(sourceDimension):
+			chain = append(chain, originSource{sourceDimension, strings.TrimPrefix(src, sourceDimension)})
+		default:
+			return nil, fmt.Errorf("unknown %s-source '%s' (should be one of %s<name> %s<name> %s %s)",
+				fixed, src, sourceTag, sourceDimension, fixed, sourceOS)
+		}
+	}
+	return chain, nil
+}
+
+// lookup returns the value of a tag or dynamic element source for m
+func (src originSource) lookup(m plugin.MetricType) string {
+	if src.kind == sourceTag {
+		return m.Tags()[src.name]
+	}
+	for _, elt := range m.Namespace() {
+		if elt.IsDynamic() && elt.Name == src.name {
+			return elt.Value
+		}
+	}
+	return ""
+}
+
+// hostnameOf returns the Hostname of the message of m, osHostname being
+// the name of the snap host. It is empty when no source gives one.
+func (op originPolicy) hostnameOf(m plugin.MetricType, osHostname string) string {
+	for _, src := range op.hostnameChain {
+		var h string
+		switch src.kind {
+		case sourceOS:
+			h = osHostname
+		case sourceTag, sourceDimension:
+			h = src.lookup(m)
+		default:
+			h = op.hostname
+		}
+		if len(h) > 0 {
+			return h
+		}
+	}
+	return ""
+}
+
+// pidOf returns the Pid of the message of m, osPid being the pid of the
+// plugin. Tag and dynamic element values which are not a pid are skipped.
+// It is 0 when no source gives one.
+func (op originPolicy) pidOf(m plugin.MetricType, osPid int32) int32 {
+	for _, src := range op.pidChain {
+		switch src.kind {
+		case sourceOS:
+			return osPid
+		case sourceTag, sourceDimension:
+			v := src.lookup(m)
+			if len(v) == 0 {
+				continue
+			}
+			pid, err := strconv.ParseInt(v, 10, 32)
+			if err != nil || pid < 0 {
+				logger.WithField("_block", "pidOf").Debug(
+					fmt.Sprintf("%s%s of metric %s is not a pid: %s",
+						src.kind, src.name, namespaceString(m), v))
+				continue
+			}
+			return int32(pid)
+		default:
+			if op.pidSet {
+				return op.pid
+			}
+		}
+	}
+	return 0
+}
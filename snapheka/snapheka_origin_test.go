@@ -0,0 +1,76 @@
+//
+// +build unit
+
+package snapheka
+
+import (
+	"testing"
+
+	"github.com/intelsdi-x/snap/core/ctypes"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestOriginPolicy(t *testing.T) {
+	Convey("Configure the Hostname and Pid sources", t, func() {
+		config := map[string]ctypes.ConfigValue{}
+
+		Convey("The fixed values and then the snap host should be used by default", func() {
+			op, err := originPolicyFromConfig(config)
+			So(err, ShouldBeNil)
+			So(op, ShouldResemble, newOriginPolicy())
+			So(op.hostnameChain, ShouldResemble, []originSource{{kind: "hostname"}, {kind: sourceOS}})
+			So(op.pidChain, ShouldResemble, []originSource{{kind: "pid"}, {kind: sourceOS}})
+		})
+		Convey("Sources should be parsed in order", func() {
+			config["hostname-source"] = ctypes.ConfigValueStr{Value: "tag:host, dimension:device,os"}
+			op, err := originPolicyFromConfig(config)
+			So(err, ShouldBeNil)
+			So(op.hostnameChain, ShouldResemble, []originSource{
+				{sourceTag, "host"}, {sourceDimension, "device"}, {kind: sourceOS}})
+		})
+		Convey("Invalid sources and pids should be rejected", func() {
+			for _, s := range []string{"tag:", "label:host", "pid", ""} {
+				config["hostname-source"] = ctypes.ConfigValueStr{Value: s}
+				_, err := originPolicyFromConfig(config)
+				So(err, ShouldNotBeNil)
+			}
+			delete(config, "hostname-source")
+			config["pid"] = ctypes.ConfigValueInt{Value: -1}
+			_, err := originPolicyFromConfig(config)
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Choose the Hostname and Pid of messages", t, func() {
+		op := newOriginPolicy()
+		m := dynamicMetric("device", "switch1", map[string]string{"pid": "42", "bad_pid": "x"}, 1)
+
+		Convey("The snap host should be used by default", func() {
+			So(op.hostnameOf(m, "snapd1"), ShouldEqual, "snapd1")
+			So(op.pidOf(m, 1234), ShouldEqual, 1234)
+		})
+		Convey("Fixed values should override the snap host", func() {
+			op.hostname = "proxy"
+			op.pid = 7
+			op.pidSet = true
+			So(op.hostnameOf(m, "snapd1"), ShouldEqual, "proxy")
+			So(op.pidOf(m, 1234), ShouldEqual, 7)
+		})
+		Convey("Tags and dynamic elements should be tried in order", func() {
+			op.hostnameChain, _ = parseOriginChain("tag:host,dimension:device,os", "hostname")
+			So(op.hostnameOf(m, "snapd1"), ShouldEqual, "switch1")
+			So(op.hostnameOf(dynamicMetric("device", "switch1", map[string]string{"host": "sw1.example.com"}, 1), "snapd1"), ShouldEqual, "sw1.example.com")
+			op.hostnameChain, _ = parseOriginChain("tag:host,dimension:port", "hostname")
+			So(op.hostnameOf(m, "snapd1"), ShouldEqual, "")
+		})
+		Convey("Values which are not a pid should be skipped", func() {
+			op.pidChain, _ = parseOriginChain("tag:bad_pid,tag:pid,os", "pid")
+			So(op.pidOf(m, 1234), ShouldEqual, 42)
+			op.pidChain, _ = parseOriginChain("tag:bad_pid,os", "pid")
+			So(op.pidOf(m, 1234), ShouldEqual, 1234)
+			op.pidChain, _ = parseOriginChain("tag:bad_pid,pid", "pid")
+			So(op.pidOf(m, 1234), ShouldEqual, 0)
+		})
+	})
+}
@@ -0,0 +1,240 @@
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2016 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package snapheka
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/intelsdi-x/snap/control/plugin"
+	"github.com/intelsdi-x/snap/core/ctypes"
+)
+
+const (
+	// Formats of the Payload of the Heka messages
+	payloadSnapJSON = "snap-json"
+	payloadNone     = "none"
+	payloadValue    = "value"
+	payloadGraphite = "graphite"
+	payloadInflux   = "influx"
+	payloadTemplate = "template"
+
+	dfltPayloadFormat = payloadSnapJSON
+)
+
+// payloadFormatter builds the Payload of the Heka message of a metric
+type payloadFormatter struct {
+	format string
+	// Template executed on the metric with the template format
+	tmpl *template.Template
+}
+
+func newPayloadFormatter() payloadFormatter {
+	return payloadFormatter{format: dfltPayloadFormat}
+}
+
+// payloadFormatterFromConfig reads payload-format and payload-template
+// from the task config
+func payloadFormatterFromConfig(config map[string]ctypes.ConfigValue) (payloadFormatter, error) {
+	pf := newPayloadFormatter()
+	pf.format = configString(config, "payload-format", pf.format)
+	text := configString(config, "payload-template", "")
+	switch pf.format {
+	case payloadSnapJSON, payloadNone, payloadValue, payloadGraphite, payloadInflux:
+		if len(text) > 0 {
+			return pf, fmt.Errorf("payload-template is only used with payload-format %s", payloadTemplate)
+		}
+	case payloadTemplate:
+		if len(text) == 0 {
+			return pf, fmt.Errorf("payload-template is required with payload-format %s", payloadTemplate)
+		}
+		tmpl, err := template.New("payload").Parse(text)
+		if err != nil {
+			return pf, fmt.Errorf("invalid payload-template: %v", err)
+		}
+		pf.tmpl = tmpl
+	default:
+		return pf, fmt.Errorf("unknown payload-format '%s' (should be one of %s %s %s %s %s %s)",
+			pf.format, payloadSnapJSON, payloadNone, payloadValue, payloadGraphite, payloadInflux, payloadTemplate)
+	}
+	return pf, nil
+}
+
+// payload returns the Payload of the Heka message of m. Unsigned integers
+// which do not fit in an int64 are handled with the overflow policy of opts.
+func (pf payloadFormatter) payload(m plugin.MetricType, opts fieldOptions) (string, error) {
+	switch pf.format {
+	case payloadNone:
+		return "", nil
+	case payloadValue:
+		return valueString(m.Data())
+	case payloadGraphite:
+		return graphiteLine(m)
+	case payloadInflux:
+		return influxLine(m, opts)
+	case payloadTemplate:
+		var buf bytes.Buffer
+		if err := pf.tmpl.Execute(&buf, m); err != nil {
+			return "", fmt.Errorf("executing payload-template on metric %s: %v", namespaceString(m), err)
+		}
+		return buf.String(), nil
+	default:
+		// snap JSON of the metric alone
+		b, _, err := plugin.MarshalMetricTypes(plugin.SnapJSONContentType, []plugin.MetricType{m})
+		return string(b), err
+	}
+}
+
+// valueString formats the data of a metric. Scalars are written as is and
+// other values as JSON.
+func valueString(v interface{}) (string, error) {
+	switch d := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return d, nil
+	case bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return fmt.Sprint(d), nil
+	case float32:
+		return strconv.FormatFloat(float64(d), 'g', -1, 32), nil
+	case float64:
+		return strconv.FormatFloat(d, 'g', -1, 64), nil
+	default:
+		b, err := json.Marshal(d)
+		return string(b), err
+	}
+}
+
+// numericString formats the data of a metric as a number, for the formats
+// which only accept numbers. It fails on other data, NaN and infinities.
+func numericString(v interface{}) (s string, isInt bool, err error) {
+	switch d := v.(type) {
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return fmt.Sprint(d), true, nil
+	case float32:
+		if math.IsNaN(float64(d)) || math.IsInf(float64(d), 0) {
+			return "", false, fmt.Errorf("%v is not a finite number", d)
+		}
+		s, _ := valueString(d)
+		return s, false, nil
+	case float64:
+		if math.IsNaN(d) || math.IsInf(d, 0) {
+			return "", false, fmt.Errorf("%v is not a finite number", d)
+		}
+		s, _ := valueString(d)
+		return s, false, nil
+	}
+	return "", false, fmt.Errorf("%T data is not a number", v)
+}
+
+// splitNamespace returns the values of the static elements of the
+// namespace of m, and its dynamic elements and tags by name
+func splitNamespace(m plugin.MetricType) (static []string, tags map[string]string) {
+	tags = make(map[string]string)
+	for _, elt := range m.Namespace() {
+		if elt.IsDynamic() {
+			tags[elt.Name] = elt.Value
+		} else {
+			static = append(static, elt.Value)
+		}
+	}
+	for k, v := range m.Tags() {
+		tags[k] = v
+	}
+	return static, tags
+}
+
+func sortedKeys(tags map[string]string) []string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// graphiteLine formats a metric as a Graphite plaintext line, without the
+// trailing newline: the full namespace as path, with the tags in Graphite
+// 1.1 tagged series syntax, the value and the collection time in seconds
+func graphiteLine(m plugin.MetricType) (string, error) {
+	value, _, err := numericString(m.Data())
+	if err != nil {
+		return "", fmt.Errorf("graphite payload of metric %s: %v", namespaceString(m), err)
+	}
+	clean := strings.NewReplacer(" ", "_", ";", "_", "=", "_")
+	path := clean.Replace(namespaceString(m))
+	tags := m.Tags()
+	for _, k := range sortedKeys(tags) {
+		path += fmt.Sprintf(";%s=%s", clean.Replace(k), clean.Replace(tags[k]))
+	}
+	return fmt.Sprintf("%s %s %d", path, value, m.Timestamp().Unix()), nil
+}
+
+// influxLine formats a metric as an InfluxDB line protocol line, without
+// the trailing newline: the static namespace elements as measurement, the
+// dynamic elements and the tags as tags, the data in a value field and the
+// collection time in nanoseconds
+func influxLine(m plugin.MetricType, opts fieldOptions) (string, error) {
+	static, tags := splitNamespace(m)
+	measurement := strings.NewReplacer(",", "\\,", " ", "\\ ").Replace(strings.Join(static, "."))
+	escape := strings.NewReplacer(",", "\\,", "=", "\\=", " ", "\\ ")
+	// string field values only escape backslashes and double quotes
+	escapeString := strings.NewReplacer("\\", "\\\\", "\"", "\\\"")
+
+	data := m.Data()
+	switch d := data.(type) {
+	case uint:
+		data = opts.convertUint(uint64(d))
+	case uint64:
+		data = opts.convertUint(d)
+	}
+	var value string
+	switch d := data.(type) {
+	case bool:
+		value = strconv.FormatBool(d)
+	case string:
+		value = "\"" + escapeString.Replace(d) + "\""
+	default:
+		s, isInt, err := numericString(d)
+		if err != nil {
+			return "", fmt.Errorf("influx payload of metric %s: %v", namespaceString(m), err)
+		}
+		value = s
+		if isInt {
+			value += "i"
+		}
+	}
+
+	line := measurement
+	for _, k := range sortedKeys(tags) {
+		if len(tags[k]) == 0 {
+			// empty tag values are not allowed
+			continue
+		}
+		line += fmt.Sprintf(",%s=%s", escape.Replace(k), escape.Replace(tags[k]))
+	}
+	return fmt.Sprintf("%s value=%s %d", line, value, m.Timestamp().UnixNano()), nil
+}
@@ -0,0 +1,154 @@
+//
+// +build unit
+
+package snapheka
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/intelsdi-x/snap/control/plugin"
+	"github.com/intelsdi-x/snap/core/ctypes"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestPayloadFormat(t *testing.T) {
+	Convey("Configure the payload format", t, func() {
+		config := map[string]ctypes.ConfigValue{}
+
+		Convey("snap-json should be the default", func() {
+			pf, err := payloadFormatterFromConfig(config)
+			So(err, ShouldBeNil)
+			So(pf.format, ShouldEqual, payloadSnapJSON)
+		})
+		Convey("An unknown format should be rejected", func() {
+			config["payload-format"] = ctypes.ConfigValueStr{Value: "xml"}
+			_, err := payloadFormatterFromConfig(config)
+			So(err, ShouldNotBeNil)
+		})
+		Convey("template should require a valid payload-template", func() {
+			config["payload-format"] = ctypes.ConfigValueStr{Value: payloadTemplate}
+			_, err := payloadFormatterFromConfig(config)
+			So(err, ShouldNotBeNil)
+			config["payload-template"] = ctypes.ConfigValueStr{Value: "{{.Data"}
+			_, err = payloadFormatterFromConfig(config)
+			So(err, ShouldNotBeNil)
+		})
+		Convey("payload-template should only be used with template", func() {
+			config["payload-template"] = ctypes.ConfigValueStr{Value: "{{.Data}}"}
+			_, err := payloadFormatterFromConfig(config)
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Build the Payload of a metric", t, func() {
+		pf := newPayloadFormatter()
+		opts := newFieldOptions()
+		metric := func(data interface{}) plugin.MetricType {
+			return dynamicMetric("host", "node 1", map[string]string{"dc": "eu"}, data)
+		}
+		m := metric(1.5)
+
+		Convey("snap-json should be the JSON of the metric", func() {
+			pl, err := pf.payload(m, opts)
+			So(err, ShouldBeNil)
+			So(pl, ShouldStartWith, "[")
+			So(pl, ShouldContainSubstring, "\"data\":1.5")
+		})
+		Convey("none should be empty", func() {
+			pf.format = payloadNone
+			pl, err := pf.payload(m, opts)
+			So(err, ShouldBeNil)
+			So(pl, ShouldEqual, "")
+		})
+		Convey("value should be the bare data", func() {
+			pf.format = payloadValue
+			pl, err := pf.payload(m, opts)
+			So(err, ShouldBeNil)
+			So(pl, ShouldEqual, "1.5")
+			pl, err = pf.payload(metric("up"), opts)
+			So(err, ShouldBeNil)
+			So(pl, ShouldEqual, "up")
+			pl, err = pf.payload(metric([]int{1, 2}), opts)
+			So(err, ShouldBeNil)
+			So(pl, ShouldEqual, "[1,2]")
+		})
+		Convey("graphite should be a plaintext line", func() {
+			pf.format = payloadGraphite
+			pl, err := pf.payload(m, opts)
+			So(err, ShouldBeNil)
+			So(pl, ShouldEqual, "intel.mock.node_1.load;dc=eu 1.5 1500000000")
+			_, err = pf.payload(metric("up"), opts)
+			So(err, ShouldNotBeNil)
+			for _, v := range []float64{math.NaN(), math.Inf(1), math.Inf(-1)} {
+				_, err = pf.payload(metric(v), opts)
+				So(err, ShouldNotBeNil)
+			}
+			_, err = pf.payload(metric(float32(math.NaN())), opts)
+			So(err, ShouldNotBeNil)
+		})
+		Convey("influx should be a line protocol line", func() {
+			pf.format = payloadInflux
+			pl, err := pf.payload(metric(int64(3)), opts)
+			So(err, ShouldBeNil)
+			So(pl, ShouldEqual, "intel.mock.load,dc=eu,host=node\\ 1 value=3i 1500000000000000000")
+			pl, err = pf.payload(metric("a \"b\""), opts)
+			So(err, ShouldBeNil)
+			So(pl, ShouldStartWith, "intel.mock.load,dc=eu,host=node\\ 1 value=\"a \\\"b\\\"\" ")
+			pl, err = pf.payload(metric("C:\\tmp\n\u00e9"), opts)
+			So(err, ShouldBeNil)
+			So(pl, ShouldStartWith, "intel.mock.load,dc=eu,host=node\\ 1 value=\"C:\\\\tmp\n\u00e9\" ")
+			_, err = pf.payload(metric(map[string]int{"a": 1}), opts)
+			So(err, ShouldNotBeNil)
+		})
+		Convey("influx should reject NaN and infinities", func() {
+			pf.format = payloadInflux
+			for _, v := range []float64{math.NaN(), math.Inf(1), math.Inf(-1)} {
+				_, err := pf.payload(metric(v), opts)
+				So(err, ShouldNotBeNil)
+			}
+		})
+		Convey("influx should apply numeric-overflow to large unsigned integers", func() {
+			pf.format = payloadInflux
+			big := metric(uint64(math.MaxUint64))
+			pl, err := pf.payload(big, opts)
+			So(err, ShouldBeNil)
+			So(pl, ShouldContainSubstring, " value=9223372036854775807i ")
+			opts.numericOverflow = overflowDouble
+			pl, err = pf.payload(big, opts)
+			So(err, ShouldBeNil)
+			So(pl, ShouldContainSubstring, " value=1.8446744073709552e+19 ")
+			opts.numericOverflow = overflowString
+			pl, err = pf.payload(big, opts)
+			So(err, ShouldBeNil)
+			So(pl, ShouldContainSubstring, " value=\"18446744073709551615\" ")
+			pl, err = pf.payload(metric(uint64(42)), opts)
+			So(err, ShouldBeNil)
+			So(pl, ShouldContainSubstring, " value=42i ")
+		})
+		Convey("template should be executed on the metric", func() {
+			config := map[string]ctypes.ConfigValue{
+				"payload-format":   ctypes.ConfigValueStr{Value: payloadTemplate},
+				"payload-template": ctypes.ConfigValueStr{Value: "{{.Namespace.String}}={{.Data}}"},
+			}
+			pf, err := payloadFormatterFromConfig(config)
+			So(err, ShouldBeNil)
+			pl, err := pf.payload(m, opts)
+			So(err, ShouldBeNil)
+			So(pl, ShouldEqual, "/intel/mock/node 1/load=1.5")
+			pf.tmpl, _ = pf.tmpl.Parse("{{.Missing}}")
+			_, err = pf.payload(m, opts)
+			So(err, ShouldNotBeNil)
+		})
+		Convey("Every format should leave the newline to the Heka encoder", func() {
+			for _, f := range []string{payloadValue, payloadGraphite, payloadInflux} {
+				pf.format = f
+				pl, err := pf.payload(m, opts)
+				So(err, ShouldBeNil)
+				So(strings.HasSuffix(pl, "\n"), ShouldBeFalse)
+			}
+		})
+	})
+}
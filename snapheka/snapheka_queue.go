@@ -0,0 +1,181 @@
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2016 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package snapheka
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/intelsdi-x/snap/control/plugin"
+)
+
+const (
+	// Queue overflow policies
+	overflowBlock      = "block"
+	overflowDropOldest = "drop-oldest"
+	overflowDropNewest = "drop-newest"
+
+	dfltQueueSize     = 10000
+	dfltQueueOverflow = overflowBlock
+)
+
+// metricQueue is a bounded in-memory queue of metrics waiting to be sent
+// to Heka by a background worker
+type metricQueue struct {
+	mutex    sync.Mutex
+	notEmpty *sync.Cond
+	notFull  *sync.Cond
+	items    []plugin.MetricType
+	size     int
+	overflow string
+	dropped  uint64
+	closed   bool
+}
+
+func newMetricQueue(size int, overflow string) (*metricQueue, error) {
+	if size < 1 {
+		return nil, fmt.Errorf("queue-size must be at least 1, got %d", size)
+	}
+	switch overflow {
+	case overflowBlock, overflowDropOldest, overflowDropNewest:
+	default:
+		return nil, fmt.Errorf("unknown queue-overflow '%s' (should be one of %s %s %s)",
+			overflow, overflowBlock, overflowDropOldest, overflowDropNewest)
+	}
+	q := &metricQueue{size: size, overflow: overflow}
+	q.notEmpty = sync.NewCond(&q.mutex)
+	q.notFull = sync.NewCond(&q.mutex)
+	return q, nil
+}
+
+// put adds metrics to the queue. When the queue is full, it waits for
+// room or drops metrics depending on the overflow policy, and returns
+// the number of metrics dropped.
+func (q *metricQueue) put(metrics []plugin.MetricType) int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	dropped := 0
+	for _, m := range metrics {
+		for len(q.items) >= q.size && q.overflow == overflowBlock && !q.closed {
+			// wake the worker up before waiting for it to make room
+			q.notEmpty.Signal()
+			q.notFull.Wait()
+		}
+		if q.closed {
+			dropped++
+			continue
+		}
+		if len(q.items) >= q.size {
+			if q.overflow == overflowDropNewest {
+				dropped++
+				continue
+			}
+			// drop-oldest
+			q.items = q.items[1:]
+			dropped++
+		}
+		q.items = append(q.items, m)
+	}
+	q.dropped += uint64(dropped)
+	q.notEmpty.Signal()
+	return dropped
+}
+
+// take waits for metrics and removes up to max of them from the queue.
+// It returns nil once the queue is closed and empty.
+func (q *metricQueue) take(max int) []plugin.MetricType {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for len(q.items) == 0 && !q.closed {
+		q.notEmpty.Wait()
+	}
+	n := len(q.items)
+	if n == 0 {
+		return nil
+	}
+	if n > max {
+		n = max
+	}
+	taken := make([]plugin.MetricType, n)
+	copy(taken, q.items[:n])
+	q.items = q.items[n:]
+	q.notFull.Broadcast()
+	return taken
+}
+
+// stats returns the number of queued metrics and the total number of
+// metrics dropped so far
+func (q *metricQueue) stats() (depth int, dropped uint64) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return len(q.items), q.dropped
+}
+
+// QueueStats returns the number of metrics waiting to be sent by the
+// background worker and the total number of metrics dropped because the
+// queue was full. Both are zero when the client is not asynchronous.
+func (shc *SnapHekaClient) QueueStats() (depth int, dropped uint64) {
+	if shc.queue == nil {
+		return 0, 0
+	}
+	return shc.queue.stats()
+}
+
+// publishAsync queues metrics for the background worker of the client
+func (shc *SnapHekaClient) publishAsync(metrics []plugin.MetricType) {
+	if dropped := shc.queue.put(metrics); dropped > 0 {
+		depth, total := shc.queue.stats()
+		logger.WithField("_block", "publishAsync").Warning(
+			fmt.Sprintf("Queue full, dropped %d metrics (queue depth=%d dropped=%d)",
+				dropped, depth, total))
+	}
+}
+
+// runWorker sends the queued metrics to Heka until the queue is closed
+func (shc *SnapHekaClient) runWorker() {
+	for {
+		metrics := shc.queue.take(shc.batchMaxMessages)
+		if metrics == nil {
+			shc.release()
+			return
+		}
+		if err := shc.sendToHeka(metrics); err != nil {
+			logger.WithField("_block", "runWorker").Error(err)
+		}
+		depth, dropped := shc.queue.stats()
+		logger.WithField("_block", "runWorker").Debug(
+			fmt.Sprintf("Sent %d metrics (queue depth=%d dropped=%d)",
+				len(metrics), depth, dropped))
+	}
+}
+
+// close wakes up the waiting producers and worker. Metrics still in the
+// queue can be taken, new ones are dropped.
+func (q *metricQueue) close() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.closed = true
+	q.notEmpty.Broadcast()
+	q.notFull.Broadcast()
+}
@@ -0,0 +1,181 @@
+//
+// +build unit
+
+package snapheka
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/intelsdi-x/snap/core/ctypes"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestMetricQueue(t *testing.T) {
+	Convey("Create a metric queue", t, func() {
+		Convey("Invalid settings should be rejected", func() {
+			_, err := newMetricQueue(0, overflowBlock)
+			So(err, ShouldNotBeNil)
+			_, err = newMetricQueue(10, "spill")
+			So(err, ShouldNotBeNil)
+		})
+		Convey("drop-newest should keep the queued metrics", func() {
+			q, err := newMetricQueue(3, overflowDropNewest)
+			So(err, ShouldBeNil)
+			metrics := mockMetrics(5)
+			So(q.put(metrics), ShouldEqual, 2)
+			taken := q.take(10)
+			So(len(taken), ShouldEqual, 3)
+			So(taken[0].Data(), ShouldEqual, 0)
+			So(taken[2].Data(), ShouldEqual, 2)
+			depth, dropped := q.stats()
+			So(depth, ShouldEqual, 0)
+			So(dropped, ShouldEqual, 2)
+		})
+		Convey("drop-oldest should keep the latest metrics", func() {
+			q, err := newMetricQueue(3, overflowDropOldest)
+			So(err, ShouldBeNil)
+			So(q.put(mockMetrics(5)), ShouldEqual, 2)
+			taken := q.take(2)
+			So(len(taken), ShouldEqual, 2)
+			So(taken[0].Data(), ShouldEqual, 2)
+			So(taken[1].Data(), ShouldEqual, 3)
+			depth, dropped := q.stats()
+			So(depth, ShouldEqual, 1)
+			So(dropped, ShouldEqual, 2)
+		})
+		Convey("block should wait for room in the queue", func() {
+			q, err := newMetricQueue(2, overflowBlock)
+			So(err, ShouldBeNil)
+			done := make(chan int, 1)
+			go func() { done <- q.put(mockMetrics(4)) }()
+			select {
+			case <-done:
+				t.Fatal("put should block on a full queue")
+			case <-time.After(50 * time.Millisecond):
+			}
+			So(len(q.take(2)), ShouldEqual, 2)
+			So(<-done, ShouldEqual, 0)
+			depth, dropped := q.stats()
+			So(depth, ShouldEqual, 2)
+			So(dropped, ShouldEqual, 0)
+		})
+		Convey("close should release the worker", func() {
+			q, err := newMetricQueue(2, overflowBlock)
+			So(err, ShouldBeNil)
+			done := make(chan bool, 1)
+			go func() { done <- q.take(1) == nil }()
+			q.close()
+			So(<-done, ShouldBeTrue)
+			So(q.put(mockMetrics(1)), ShouldEqual, 1)
+		})
+	})
+}
+
+func TestHekaAsync(t *testing.T) {
+	defer hekaConns.closeAll()
+
+	Convey("Publish metrics asynchronously", t, func() {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		defer l.Close()
+		received := readAll(l)
+		config := map[string]ctypes.ConfigValue{
+			"endpoints":      ctypes.ConfigValueStr{Value: l.Addr().String()},
+			"async":          ctypes.ConfigValueBool{Value: true},
+			"queue-size":     ctypes.ConfigValueInt{Value: 100},
+			"queue-overflow": ctypes.ConfigValueStr{Value: overflowDropNewest},
+		}
+
+		shc, err := newClientFromConfig(config)
+		So(err, ShouldBeNil)
+		So(shc.queue != nil, ShouldBeTrue)
+		So(shc.publish(mockMetrics(10)), ShouldBeNil)
+		// the worker closes its connection once the queue is drained
+		shc.queue.close()
+		n, err := countFrames(<-received)
+		So(err, ShouldBeNil)
+		So(n, ShouldEqual, 10)
+	})
+
+	Convey("Publish more metrics than the queue holds with block", t, func() {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		defer l.Close()
+		received := readAll(l)
+		config := map[string]ctypes.ConfigValue{
+			"endpoints":      ctypes.ConfigValueStr{Value: l.Addr().String()},
+			"async":          ctypes.ConfigValueBool{Value: true},
+			"queue-size":     ctypes.ConfigValueInt{Value: 3},
+			"queue-overflow": ctypes.ConfigValueStr{Value: overflowBlock},
+		}
+
+		shc, err := newClientFromConfig(config)
+		So(err, ShouldBeNil)
+		done := make(chan error, 1)
+		go func() { done <- shc.publish(mockMetrics(10)) }()
+		select {
+		case err = <-done:
+			So(err, ShouldBeNil)
+		case <-time.After(5 * time.Second):
+			t.Fatal("publish should not block once the worker makes room")
+		}
+		shc.queue.close()
+		n, err := countFrames(<-received)
+		So(err, ShouldBeNil)
+		So(n, ShouldEqual, 10)
+	})
+}
+
+func TestClientExpiry(t *testing.T) {
+	Convey("Close the clients of task configs not used anymore", t, func() {
+		p := NewHekaPublisher()
+		config := func(size int) map[string]ctypes.ConfigValue {
+			return map[string]ctypes.ConfigValue{
+				"endpoints":  ctypes.ConfigValueStr{Value: "127.0.0.1:5565"},
+				"async":      ctypes.ConfigValueBool{Value: true},
+				"queue-size": ctypes.ConfigValueInt{Value: size},
+			}
+		}
+		old, err := p.getClient(config(10))
+		So(err, ShouldBeNil)
+		Reset(func() {
+			old.close()
+			for _, shc := range p.clients {
+				shc.close()
+			}
+		})
+		So(old.publish(mockMetrics(0)), ShouldBeNil)
+		depth, dropped := old.QueueStats()
+		So(depth, ShouldEqual, 0)
+		So(dropped, ShouldEqual, 0)
+
+		Convey("A recently used client should be kept", func() {
+			_, err := p.getClient(config(20))
+			So(err, ShouldBeNil)
+			So(len(p.clients), ShouldEqual, 2)
+			shc, err := p.getClient(config(10))
+			So(err, ShouldBeNil)
+			So(shc, ShouldEqual, old)
+		})
+		Convey("An expired client should be closed and removed", func() {
+			for key := range p.lastUsed {
+				p.lastUsed[key] = time.Now().Add(-2 * p.expiry)
+			}
+			_, err := p.getClient(config(20))
+			So(err, ShouldBeNil)
+			So(len(p.clients), ShouldEqual, 1)
+			So(old.queue.take(1), ShouldBeNil)
+		})
+	})
+
+	Convey("A synchronous client should have no queue stats", t, func() {
+		shc, err := NewSnapHekaClient("tcp://localhost:5565", "")
+		So(err, ShouldBeNil)
+		depth, dropped := shc.QueueStats()
+		So(depth, ShouldEqual, 0)
+		So(dropped, ShouldEqual, 0)
+	})
+}
@@ -0,0 +1,89 @@
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2016 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package snapheka
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/intelsdi-x/snap/core/ctypes"
+)
+
+const (
+	dfltRetryMaxAttempts = 3
+	dfltRetryBackoff     = 100 * time.Millisecond
+	dfltRetryMaxBackoff  = 5 * time.Second
+)
+
+// retryPolicy defines how many times sending to Heka is attempted
+// and how long to wait between two attempts
+type retryPolicy struct {
+	maxAttempts int
+	backoff     time.Duration
+	maxBackoff  time.Duration
+}
+
+func newRetryPolicy() retryPolicy {
+	return retryPolicy{
+		maxAttempts: dfltRetryMaxAttempts,
+		backoff:     dfltRetryBackoff,
+		maxBackoff:  dfltRetryMaxBackoff,
+	}
+}
+
+// retryPolicyFromConfig builds the retry policy from the task config,
+// using the defaults for the keys which are not set
+func retryPolicyFromConfig(config map[string]ctypes.ConfigValue) (retryPolicy, error) {
+	rp := newRetryPolicy()
+	var err error
+	rp.maxAttempts = configInt(config, "retry-max-attempts", rp.maxAttempts)
+	if rp.maxAttempts < 1 {
+		return rp, fmt.Errorf("retry-max-attempts must be at least 1, got %d", rp.maxAttempts)
+	}
+	if rp.backoff, err = configDuration(config, "retry-backoff", rp.backoff); err != nil {
+		return rp, err
+	}
+	if rp.maxBackoff, err = configDuration(config, "retry-max-backoff", rp.maxBackoff); err != nil {
+		return rp, err
+	}
+	if rp.maxBackoff < rp.backoff {
+		return rp, fmt.Errorf("retry-max-backoff (%v) is lower than retry-backoff (%v)", rp.maxBackoff, rp.backoff)
+	}
+	return rp, nil
+}
+
+// delay returns the time to wait before the given retry (starting at 1).
+// The delay doubles at every retry up to maxBackoff, and a random jitter
+// of up to half of it is subtracted so that senders do not retry in lockstep.
+func (rp retryPolicy) delay(retry int) time.Duration {
+	d := rp.backoff
+	for i := 1; i < retry && d < rp.maxBackoff; i++ {
+		d *= 2
+	}
+	if d > rp.maxBackoff {
+		d = rp.maxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	half := int64(d / 2)
+	return time.Duration(half + rand.Int63n(half+1))
+}
@@ -0,0 +1,99 @@
+//
+// +build unit
+
+package snapheka
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/intelsdi-x/snap/control/plugin"
+	"github.com/intelsdi-x/snap/core"
+	"github.com/intelsdi-x/snap/core/ctypes"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	Convey("Create a retry policy", t, func() {
+		rp := retryPolicy{maxAttempts: 5, backoff: 100 * time.Millisecond, maxBackoff: time.Second}
+
+		Convey("Delays should grow exponentially with jitter", func() {
+			So(rp.delay(1), ShouldBeBetweenOrEqual, 50*time.Millisecond, 100*time.Millisecond)
+			So(rp.delay(2), ShouldBeBetweenOrEqual, 100*time.Millisecond, 200*time.Millisecond)
+			So(rp.delay(3), ShouldBeBetweenOrEqual, 200*time.Millisecond, 400*time.Millisecond)
+		})
+		Convey("Delays should be capped by the maximum backoff", func() {
+			So(rp.delay(10), ShouldBeBetweenOrEqual, 500*time.Millisecond, time.Second)
+			So(rp.delay(100), ShouldBeBetweenOrEqual, 500*time.Millisecond, time.Second)
+		})
+	})
+
+	Convey("Read the retry policy from config", t, func() {
+		config := make(map[string]ctypes.ConfigValue)
+
+		Convey("Defaults should be used when nothing is set", func() {
+			rp, err := retryPolicyFromConfig(config)
+			So(err, ShouldBeNil)
+			So(rp, ShouldResemble, newRetryPolicy())
+		})
+		Convey("Configured values should be used", func() {
+			config["retry-max-attempts"] = ctypes.ConfigValueInt{Value: 7}
+			config["retry-backoff"] = ctypes.ConfigValueStr{Value: "1s"}
+			config["retry-max-backoff"] = ctypes.ConfigValueStr{Value: "1m"}
+			rp, err := retryPolicyFromConfig(config)
+			So(err, ShouldBeNil)
+			So(rp.maxAttempts, ShouldEqual, 7)
+			So(rp.backoff, ShouldEqual, time.Second)
+			So(rp.maxBackoff, ShouldEqual, time.Minute)
+		})
+		Convey("Invalid values should be rejected", func() {
+			config["retry-max-attempts"] = ctypes.ConfigValueInt{Value: 0}
+			_, err := retryPolicyFromConfig(config)
+			So(err, ShouldNotBeNil)
+			config["retry-max-attempts"] = ctypes.ConfigValueInt{Value: 1}
+			config["retry-backoff"] = ctypes.ConfigValueStr{Value: "soon"}
+			_, err = retryPolicyFromConfig(config)
+			So(err, ShouldNotBeNil)
+			config["retry-backoff"] = ctypes.ConfigValueStr{Value: "10s"}
+			config["retry-max-backoff"] = ctypes.ConfigValueStr{Value: "1s"}
+			_, err = retryPolicyFromConfig(config)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestSendToHekaRetry(t *testing.T) {
+	metrics := []plugin.MetricType{
+		*plugin.NewMetricType(core.NewNamespace("intel", "mock", "foo"), time.Now(), nil, "", 1),
+		*plugin.NewMetricType(core.NewNamespace("intel", "mock", "bar"), time.Now(), nil, "", 2),
+	}
+	defer hekaConns.closeAll()
+
+	Convey("Send metrics to a Heka endpoint", t, func() {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		addr := l.Addr().String()
+		shc, err := NewSnapHekaClient("tcp://"+addr, "")
+		So(err, ShouldBeNil)
+		shc.retry = retryPolicy{maxAttempts: 3, backoff: time.Millisecond, maxBackoff: 5 * time.Millisecond}
+
+		Convey("Messages should be delivered when Heka is reachable", func() {
+			received := readAll(l)
+			So(shc.sendToHeka(metrics), ShouldBeNil)
+			hekaConns.closeAll()
+			l.Close()
+			b := <-received
+			So(len(b), ShouldBeGreaterThan, 0)
+			So(b[0], ShouldEqual, 0x1e)
+		})
+
+		Convey("An error should be returned when every attempt fails", func() {
+			l.Close()
+			err := shc.sendToHeka(metrics)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "2 of 2 messages")
+		})
+	})
+}
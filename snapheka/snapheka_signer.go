@@ -0,0 +1,69 @@
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2016 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package snapheka
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mozilla-services/heka/message"
+
+	"github.com/intelsdi-x/snap/core/ctypes"
+)
+
+const dfltSignerHash = "md5"
+
+// signerFromConfig builds the Heka message signing configuration from the
+// task config. It returns nil when signer-name is not set, in which case
+// messages are sent unsigned.
+func signerFromConfig(config map[string]ctypes.ConfigValue) (*message.MessageSigningConfig, error) {
+	name := configString(config, "signer-name", "")
+	if len(name) == 0 {
+		return nil, nil
+	}
+
+	hash := strings.ToLower(configString(config, "signer-hash", dfltSignerHash))
+	if hash != "md5" && hash != "sha1" {
+		return nil, fmt.Errorf("signer-hash '%s' is not supported (should be md5 or sha1)", hash)
+	}
+	version := configInt(config, "signer-key-version", 0)
+	if version < 0 {
+		return nil, fmt.Errorf("signer-key-version must not be negative, got %d", version)
+	}
+
+	// The key is never put in the task manifest itself
+	key, set, err := configSecret(config, "signer-key-file", "signer-key-env")
+	if err != nil {
+		return nil, err
+	}
+	if !set {
+		return nil, fmt.Errorf("signer-key-file or signer-key-env is required with signer-name")
+	}
+	if len(key) == 0 {
+		return nil, fmt.Errorf("the HMAC key of signer %s is empty", name)
+	}
+
+	return &message.MessageSigningConfig{
+		Name:    name,
+		Hash:    hash,
+		Key:     key,
+		Version: uint32(version),
+	}, nil
+}
@@ -0,0 +1,93 @@
+//
+// +build unit
+
+package snapheka
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mozilla-services/heka/client"
+	"github.com/mozilla-services/heka/message"
+
+	"github.com/intelsdi-x/snap/control/plugin"
+	"github.com/intelsdi-x/snap/core"
+	"github.com/intelsdi-x/snap/core/ctypes"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestHekaSigner(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapheka-signer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keyFile := filepath.Join(dir, "hmac.key")
+	if err := ioutil.WriteFile(keyFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	Convey("Build the message signing config", t, func() {
+		config := make(map[string]ctypes.ConfigValue)
+
+		Convey("Messages should not be signed by default", func() {
+			signer, err := signerFromConfig(config)
+			So(err, ShouldBeNil)
+			So(signer, ShouldBeNil)
+		})
+		Convey("The key should be read from a file", func() {
+			config["signer-name"] = ctypes.ConfigValueStr{Value: "snap"}
+			config["signer-key-version"] = ctypes.ConfigValueInt{Value: 2}
+			config["signer-hash"] = ctypes.ConfigValueStr{Value: "SHA1"}
+			config["signer-key-file"] = ctypes.ConfigValueStr{Value: keyFile}
+			signer, err := signerFromConfig(config)
+			So(err, ShouldBeNil)
+			So(signer, ShouldResemble, &message.MessageSigningConfig{
+				Name: "snap", Hash: "sha1", Key: "secret", Version: 2})
+		})
+		Convey("The key should be read from the environment", func() {
+			os.Setenv("SNAP_HEKA_TEST_HMAC_KEY", "envsecret")
+			defer os.Unsetenv("SNAP_HEKA_TEST_HMAC_KEY")
+			config["signer-name"] = ctypes.ConfigValueStr{Value: "snap"}
+			config["signer-key-env"] = ctypes.ConfigValueStr{Value: "SNAP_HEKA_TEST_HMAC_KEY"}
+			signer, err := signerFromConfig(config)
+			So(err, ShouldBeNil)
+			So(signer.Key, ShouldEqual, "envsecret")
+			So(signer.Hash, ShouldEqual, "md5")
+		})
+		Convey("Invalid signing configs should be rejected", func() {
+			config["signer-name"] = ctypes.ConfigValueStr{Value: "snap"}
+			_, err := signerFromConfig(config)
+			So(err, ShouldNotBeNil)
+			config["signer-key-env"] = ctypes.ConfigValueStr{Value: "SNAP_HEKA_TEST_UNSET_KEY"}
+			_, err = signerFromConfig(config)
+			So(err, ShouldNotBeNil)
+			config["signer-key-file"] = ctypes.ConfigValueStr{Value: keyFile}
+			_, err = signerFromConfig(config)
+			So(err, ShouldNotBeNil)
+			delete(config, "signer-key-env")
+			config["signer-hash"] = ctypes.ConfigValueStr{Value: "sha256"}
+			_, err = signerFromConfig(config)
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Signed messages should carry the signer in their header", t, func() {
+		signer := &message.MessageSigningConfig{Name: "snap", Hash: "sha1", Key: "secret", Version: 2}
+		metric := *plugin.NewMetricType(core.NewNamespace("intel", "mock", "foo"), time.Now(), nil, "", 1)
+		msg, err := createHekaMessage("", metric, 1234, "host0", newFieldOptions())
+		So(err, ShouldBeNil)
+		var buf []byte
+		So(client.NewProtobufEncoder(signer).EncodeMessageStream(msg, &buf), ShouldBeNil)
+		header, _, err := decodeFrame(buf)
+		So(err, ShouldBeNil)
+		So(header.GetHmacSigner(), ShouldEqual, "snap")
+		So(header.GetHmacKeyVersion(), ShouldEqual, 2)
+		So(header.GetHmacHashFunction(), ShouldEqual, message.Header_SHA1)
+		So(len(header.GetHmac()), ShouldBeGreaterThan, 0)
+	})
+}
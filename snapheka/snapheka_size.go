@@ -0,0 +1,86 @@
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2016 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package snapheka
+
+import (
+	"fmt"
+	"unicode/utf8"
+
+	"github.com/mozilla-services/heka/message"
+
+	"github.com/intelsdi-x/snap/control/plugin"
+)
+
+const (
+	// What to do with messages larger than max-message-size
+	oversizeTruncate    = "truncate"
+	oversizeDropPayload = "drop-payload"
+	oversizeReject      = "reject"
+
+	// Default max_message_size of hekad
+	SnapDfltMaxMessageSize = 64 * 1024
+	dfltOversizeStrategy   = oversizeReject
+)
+
+// limitMessageSize makes sure that a message fits in maxMessageSize before
+// it is encoded, the Heka encoder refusing messages larger than
+// message.MAX_MESSAGE_SIZE. Depending on oversizeStrategy, the payload of a
+// larger message is cut or emptied, or an error is returned.
+func (shc *SnapHekaClient) limitMessageSize(msg *message.Message, m plugin.MetricType) error {
+	length := msg.Size()
+	if length <= shc.maxMessageSize {
+		return nil
+	}
+	tooLarge := fmt.Errorf("message for metric %s is %d bytes, larger than max-message-size (%d bytes)",
+		namespaceString(m), length, shc.maxMessageSize)
+
+	payload := msg.GetPayload()
+	switch shc.oversizeStrategy {
+	case oversizeTruncate:
+		// the encoded length of the payload shrinks at least as much
+		// as the payload itself
+		msg.SetPayload(truncateUTF8(payload, len(payload)-(length-shc.maxMessageSize)))
+	case oversizeDropPayload:
+		msg.SetPayload("")
+	default:
+		return tooLarge
+	}
+	if msg.Size() > shc.maxMessageSize {
+		return fmt.Errorf("%v, even without its payload", tooLarge)
+	}
+	logger.WithField("_block", "limitMessageSize").Warning(
+		fmt.Sprintf("%v, payload cut from %d to %d bytes (%s)",
+			tooLarge, len(payload), len(msg.GetPayload()), shc.oversizeStrategy))
+	return nil
+}
+
+// truncateUTF8 cuts s to at most n bytes without splitting a character
+func truncateUTF8(s string, n int) string {
+	if n <= 0 {
+		return ""
+	}
+	if n >= len(s) {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
@@ -0,0 +1,137 @@
+//
+// +build unit
+
+package snapheka
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/mozilla-services/heka/message"
+
+	"github.com/intelsdi-x/snap/control/plugin"
+	"github.com/intelsdi-x/snap/core"
+	"github.com/intelsdi-x/snap/core/ctypes"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// metricMessage builds the Heka message of a metric with the given payload
+func metricMessage(m plugin.MetricType, payload string) *message.Message {
+	msg, err := createHekaMessage(payload, m, 1, "localhost", newFieldOptions())
+	So(err, ShouldBeNil)
+	return msg
+}
+
+func TestMessageSize(t *testing.T) {
+	defer hekaConns.closeAll()
+
+	Convey("Limit the size of Heka messages", t, func() {
+		shc, err := NewSnapHekaClient("tcp://localhost:5565", "")
+		So(err, ShouldBeNil)
+		shc.maxMessageSize = 1024
+		m := *plugin.NewMetricType(core.NewNamespace("intel", "mock", "foo"), time.Now(), nil, "", 1)
+		payload := strings.Repeat("é", 1000)
+
+		Convey("Small messages should be kept as they are", func() {
+			msg := metricMessage(m, "small")
+			So(shc.limitMessageSize(msg, m), ShouldBeNil)
+			So(msg.GetPayload(), ShouldEqual, "small")
+		})
+		Convey("Large messages should be rejected by default", func() {
+			err := shc.limitMessageSize(metricMessage(m, payload), m)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "larger than max-message-size")
+		})
+		Convey("The payload of large messages should be truncated", func() {
+			shc.oversizeStrategy = oversizeTruncate
+			msg := metricMessage(m, payload)
+			So(shc.limitMessageSize(msg, m), ShouldBeNil)
+			So(msg.Size(), ShouldBeLessThanOrEqualTo, 1024)
+			So(len(msg.GetPayload()), ShouldBeGreaterThan, 0)
+			So(strings.HasPrefix(payload, msg.GetPayload()), ShouldBeTrue)
+			So(utf8.ValidString(msg.GetPayload()), ShouldBeTrue)
+			So(msg.FindFirstField("value").GetValue(), ShouldEqual, int64(1))
+		})
+		Convey("The payload of large messages should be dropped", func() {
+			shc.oversizeStrategy = oversizeDropPayload
+			msg := metricMessage(m, payload)
+			So(shc.limitMessageSize(msg, m), ShouldBeNil)
+			So(msg.GetPayload(), ShouldBeEmpty)
+			So(msg.FindFirstField("value").GetValue(), ShouldEqual, int64(1))
+		})
+		Convey("Messages too large without payload should be rejected", func() {
+			shc.oversizeStrategy = oversizeDropPayload
+			big := *plugin.NewMetricType(core.NewNamespace("intel", "mock", "foo"), time.Now(), nil, "", payload)
+			err := shc.limitMessageSize(metricMessage(big, payload), big)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "without its payload")
+		})
+		Convey("sendToHeka should report rejected messages", func() {
+			big := *plugin.NewMetricType(core.NewNamespace("intel", "mock", "foo"), time.Now(), nil, "", payload)
+			err := shc.sendToHeka([]plugin.MetricType{big})
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "1 of 1 messages were rejected")
+		})
+	})
+
+	Convey("Send metrics larger than the Heka encoder accepts", t, func() {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		defer l.Close()
+		received := readAll(l)
+		shc, err := newClientFromConfig(map[string]ctypes.ConfigValue{
+			"endpoints":         ctypes.ConfigValueStr{Value: l.Addr().String()},
+			"oversize-strategy": ctypes.ConfigValueStr{Value: oversizeTruncate},
+			"payload-format":    ctypes.ConfigValueStr{Value: payloadTemplate},
+			// The payload is as many bytes as the value of the metric
+			"payload-template": ctypes.ConfigValueStr{Value: `{{printf "%0*d" .Data 0}}`},
+		})
+		So(err, ShouldBeNil)
+		So(shc.maxMessageSize, ShouldEqual, SnapDfltMaxMessageSize)
+		big := *plugin.NewMetricType(core.NewNamespace("intel", "mock", "foo"), time.Now(), nil, "", 2*SnapDfltMaxMessageSize)
+
+		Convey("The payload should be truncated with the default limit", func() {
+			So(shc.sendToHeka([]plugin.MetricType{big}), ShouldBeNil)
+			hekaConns.closeAll()
+			b := <-received
+			header, msg, err := decodeFrame(b)
+			So(err, ShouldBeNil)
+			So(header.GetMessageLength(), ShouldBeLessThanOrEqualTo, SnapDfltMaxMessageSize)
+			So(len(msg.GetPayload()), ShouldBeGreaterThan, 0)
+		})
+		Convey("The metric should be reported when it can not be sent", func() {
+			shc.oversizeStrategy = oversizeReject
+			err := shc.sendToHeka([]plugin.MetricType{big, mockMetrics(1)[0]})
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "1 of 2 messages were rejected")
+			hekaConns.closeAll()
+			n, err := countFrames(<-received)
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 1)
+		})
+	})
+
+	Convey("max-message-size should not exceed what the Heka encoder accepts", t, func() {
+		config := map[string]ctypes.ConfigValue{
+			"host":             ctypes.ConfigValueStr{Value: "localhost"},
+			"port":             ctypes.ConfigValueInt{Value: 5565},
+			"max-message-size": ctypes.ConfigValueInt{Value: int(message.MAX_MESSAGE_SIZE) + 1},
+		}
+		_, err := newClientFromConfig(config)
+		So(err, ShouldNotBeNil)
+		config["max-message-size"] = ctypes.ConfigValueInt{Value: 1024}
+		_, err = newClientFromConfig(config)
+		So(err, ShouldBeNil)
+	})
+
+	Convey("Truncate strings on character boundaries", t, func() {
+		So(truncateUTF8("héllo", 2), ShouldEqual, "h")
+		So(truncateUTF8("héllo", 3), ShouldEqual, "hé")
+		So(truncateUTF8("héllo", 10), ShouldEqual, "héllo")
+		So(truncateUTF8("héllo", -1), ShouldEqual, "")
+	})
+}
@@ -0,0 +1,456 @@
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2016 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package snapheka
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/intelsdi-x/snap/core/ctypes"
+)
+
+const (
+	// Spool fsync policies
+	fsyncAlways  = "always"
+	fsyncSegment = "segment"
+	fsyncNever   = "never"
+
+	dfltSpoolMaxBytes     = 256 * 1024 * 1024
+	dfltSpoolSegmentBytes = 4 * 1024 * 1024
+	dfltSpoolMaxAge       = 24 * time.Hour
+	dfltSpoolFsync        = fsyncAlways
+
+	spoolSuffix = ".spool"
+	// Length and CRC-32 of the record payload
+	spoolHeaderSize = 8
+)
+
+// spoolSegment is a file of the spool holding records in append order
+type spoolSegment struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// spoolRecord is a message read back from the spool. end is the offset
+// following the record in its segment.
+type spoolRecord struct {
+	frame hekaFrame
+	end   int64
+}
+
+// spool keeps the framed Heka messages which could not be sent in segment
+// files of a directory, so that they are sent later in the same order.
+// Each record is made of the length and CRC-32 of its payload, followed by
+// the payload: the length of the metric name, the metric name and the
+// framed message.
+type spool struct {
+	mutex        sync.Mutex
+	dir          string
+	maxBytes     int64
+	segmentBytes int64
+	maxAge       time.Duration
+	fsync        string
+	// Segments from the oldest to the newest, the last one may be active
+	segments []*spoolSegment
+	active   *os.File
+	// Offset of the first record not sent yet in the oldest segment
+	headOffset int64
+	nextSeq    uint64
+	dropped    uint64
+}
+
+// spoolFromConfig creates the spool configured in the task config.
+// It returns nil when spool-dir is not set.
+func spoolFromConfig(config map[string]ctypes.ConfigValue) (*spool, error) {
+	dir := configString(config, "spool-dir", "")
+	if len(dir) == 0 {
+		return nil, nil
+	}
+	maxAge, err := configDuration(config, "spool-max-age", dfltSpoolMaxAge)
+	if err != nil {
+		return nil, err
+	}
+	return newSpool(dir,
+		int64(configInt(config, "spool-max-bytes", dfltSpoolMaxBytes)),
+		int64(configInt(config, "spool-segment-bytes", dfltSpoolSegmentBytes)),
+		maxAge,
+		configString(config, "spool-fsync", dfltSpoolFsync))
+}
+
+// newSpool opens the spool in dir, creating the directory if needed.
+// Segments left by a previous run are kept and sent first.
+func newSpool(dir string, maxBytes, segmentBytes int64, maxAge time.Duration, fsync string) (*spool, error) {
+	if segmentBytes < 1 || maxBytes < segmentBytes {
+		return nil, fmt.Errorf("spool-segment-bytes must be between 1 and spool-max-bytes (%d), got %d",
+			maxBytes, segmentBytes)
+	}
+	switch fsync {
+	case fsyncAlways, fsyncSegment, fsyncNever:
+	default:
+		return nil, fmt.Errorf("unknown spool-fsync '%s' (should be one of %s %s %s)",
+			fsync, fsyncAlways, fsyncSegment, fsyncNever)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("creating spool-dir %s: %v", dir, err)
+	}
+	s := &spool{
+		dir:          dir,
+		maxBytes:     maxBytes,
+		segmentBytes: segmentBytes,
+		maxAge:       maxAge,
+		fsync:        fsync,
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("reading spool-dir %s: %v", dir, err)
+	}
+	var seqs []uint64
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), spoolSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(f.Name(), spoolSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Sort(bySeq(seqs))
+	for _, seq := range seqs {
+		fi, err := os.Stat(s.segmentPath(seq))
+		if err != nil {
+			return nil, err
+		}
+		s.segments = append(s.segments, &spoolSegment{s.segmentPath(seq), fi.Size(), fi.ModTime()})
+		s.nextSeq = seq + 1
+	}
+	if len(s.segments) > 0 {
+		logger.WithField("_block", "newSpool").Info(
+			fmt.Sprintf("Found %d spool segments in %s", len(s.segments), dir))
+	}
+	return s, nil
+}
+
+type bySeq []uint64
+
+func (s bySeq) Len() int           { return len(s) }
+func (s bySeq) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s bySeq) Less(i, j int) bool { return s[i] < s[j] }
+
+func (s *spool) segmentPath(seq uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", seq, spoolSuffix))
+}
+
+// empty tells whether every spooled message has been sent
+func (s *spool) empty() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.expire()
+	return len(s.segments) == 0
+}
+
+// append writes framed messages at the end of the spool. The oldest
+// segments are dropped when the spool grows over maxBytes.
+func (s *spool) append(frames []hekaFrame) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, f := range frames {
+		rec := encodeSpoolRecord(f)
+		if s.active == nil || s.activeSegment().size+int64(len(rec)) > s.segmentBytes {
+			if err := s.rotate(); err != nil {
+				return err
+			}
+		}
+		if _, err := s.active.Write(rec); err != nil {
+			return fmt.Errorf("writing spool segment %s: %v", s.active.Name(), err)
+		}
+		seg := s.activeSegment()
+		seg.size += int64(len(rec))
+		seg.modTime = time.Now()
+	}
+	if s.fsync == fsyncAlways && s.active != nil {
+		if err := s.active.Sync(); err != nil {
+			return fmt.Errorf("syncing spool segment %s: %v", s.active.Name(), err)
+		}
+	}
+	s.expire()
+	s.enforceMaxBytes()
+	return nil
+}
+
+func encodeSpoolRecord(f hekaFrame) []byte {
+	payload := make([]byte, 2, 2+len(f.key)+len(f.buf))
+	binary.BigEndian.PutUint16(payload, uint16(len(f.key)))
+	payload = append(payload, f.key...)
+	payload = append(payload, f.buf...)
+	rec := make([]byte, spoolHeaderSize, spoolHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(rec, uint32(len(payload)))
+	binary.BigEndian.PutUint32(rec[4:], crc32.ChecksumIEEE(payload))
+	return append(rec, payload...)
+}
+
+// activeSegment returns the segment being written
+func (s *spool) activeSegment() *spoolSegment {
+	return s.segments[len(s.segments)-1]
+}
+
+// rotate closes the active segment and starts a new one
+func (s *spool) rotate() error {
+	s.closeActive()
+	path := s.segmentPath(s.nextSeq)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("creating spool segment %s: %v", path, err)
+	}
+	s.nextSeq++
+	s.active = f
+	s.segments = append(s.segments, &spoolSegment{path: path, modTime: time.Now()})
+	return nil
+}
+
+func (s *spool) closeActive() {
+	if s.active == nil {
+		return
+	}
+	if s.fsync == fsyncSegment {
+		if err := s.active.Sync(); err != nil {
+			logger.WithField("_block", "spool").Warning(
+				fmt.Sprintf("syncing spool segment %s: %v", s.active.Name(), err))
+		}
+	}
+	s.active.Close()
+	s.active = nil
+}
+
+// expire drops the segments whose last message is older than maxAge
+func (s *spool) expire() {
+	if s.maxAge <= 0 {
+		return
+	}
+	limit := time.Now().Add(-s.maxAge)
+	for len(s.segments) > 0 && s.segments[0].modTime.Before(limit) {
+		s.dropOldest(fmt.Sprintf("older than spool-max-age (%v)", s.maxAge))
+	}
+}
+
+// enforceMaxBytes drops the oldest segments until the spool fits in maxBytes
+func (s *spool) enforceMaxBytes() {
+	for len(s.segments) > 1 && s.totalBytes() > s.maxBytes {
+		s.dropOldest(fmt.Sprintf("spool is over spool-max-bytes (%d)", s.maxBytes))
+	}
+}
+
+func (s *spool) totalBytes() int64 {
+	var total int64
+	for _, seg := range s.segments {
+		total += seg.size
+	}
+	return total - s.headOffset
+}
+
+// dropOldest removes the oldest segment along with its unsent messages
+func (s *spool) dropOldest(reason string) {
+	seg := s.segments[0]
+	records, _ := readSpoolRecords(seg.path, s.headOffset)
+	s.dropped += uint64(len(records))
+	logger.WithField("_block", "spool").Warning(
+		fmt.Sprintf("Dropping %d spooled messages of %s: %s (%d dropped so far)",
+			len(records), seg.path, reason, s.dropped))
+	s.removeOldest()
+}
+
+// removeOldest deletes the oldest segment
+func (s *spool) removeOldest() {
+	if len(s.segments) == 1 {
+		s.closeActive()
+	}
+	if err := os.Remove(s.segments[0].path); err != nil && !os.IsNotExist(err) {
+		logger.WithField("_block", "spool").Warning(
+			fmt.Sprintf("removing spool segment %s: %v", s.segments[0].path, err))
+	}
+	s.segments = s.segments[1:]
+	s.headOffset = 0
+}
+
+// head returns the unsent messages of the oldest segment
+func (s *spool) head() []spoolRecord {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for len(s.segments) > 0 {
+		seg := s.segments[0]
+		records, err := readSpoolRecords(seg.path, s.headOffset)
+		if err != nil {
+			logger.WithField("_block", "spool").Warning(
+				fmt.Sprintf("spool segment %s is corrupted, skipping to the next valid message: %v", seg.path, err))
+			// A corrupted tail is discarded along with the last good record,
+			// unless the segment is still being written
+			if len(records) > 0 && (s.active == nil || len(s.segments) > 1) {
+				records[len(records)-1].end = seg.size
+			}
+		}
+		if len(records) > 0 {
+			return records
+		}
+		if s.active != nil && len(s.segments) == 1 {
+			// nothing left to send in the segment being written
+			return nil
+		}
+		s.removeOldest()
+	}
+	return nil
+}
+
+// consume marks the messages of the oldest segment up to offset end as
+// sent. The segment is deleted once all its messages are sent.
+func (s *spool) consume(end int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if len(s.segments) == 0 {
+		return
+	}
+	s.headOffset = end
+	if s.headOffset >= s.segments[0].size {
+		s.removeOldest()
+	}
+}
+
+// readSpoolRecords decodes the records of a segment file from offset.
+// Corrupted or truncated data is skipped up to the next valid record, and
+// reported in the returned error along with the records read.
+func readSpoolRecords(path string, offset int64) ([]spoolRecord, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var records []spoolRecord
+	var corrupted error
+	var skipped int64
+	for pos := offset; pos < int64(len(b)); {
+		rec, err := decodeSpoolRecord(b, pos)
+		if err != nil {
+			if corrupted == nil {
+				corrupted = err
+			}
+			// resyncs on the next offset holding a valid record
+			pos++
+			skipped++
+			continue
+		}
+		records = append(records, rec)
+		pos = rec.end
+	}
+	if corrupted != nil {
+		return records, fmt.Errorf("%v, %d bytes skipped", corrupted, skipped)
+	}
+	return records, nil
+}
+
+// decodeSpoolRecord decodes the record at offset pos of a segment
+func decodeSpoolRecord(b []byte, pos int64) (spoolRecord, error) {
+	if int64(len(b))-pos < spoolHeaderSize {
+		return spoolRecord{}, fmt.Errorf("truncated record header at offset %d", pos)
+	}
+	size := int64(binary.BigEndian.Uint32(b[pos:]))
+	sum := binary.BigEndian.Uint32(b[pos+4:])
+	start := pos + spoolHeaderSize
+	if size < 2 || size > int64(len(b))-start {
+		return spoolRecord{}, fmt.Errorf("invalid record length %d at offset %d", size, pos)
+	}
+	payload := b[start : start+size]
+	if crc32.ChecksumIEEE(payload) != sum {
+		return spoolRecord{}, fmt.Errorf("checksum mismatch at offset %d", pos)
+	}
+	keyLen := int64(binary.BigEndian.Uint16(payload))
+	if 2+keyLen > size {
+		return spoolRecord{}, fmt.Errorf("invalid metric name length %d at offset %d", keyLen, pos)
+	}
+	return spoolRecord{
+		frame: hekaFrame{key: string(payload[2 : 2+keyLen]), buf: payload[2+keyLen:]},
+		end:   start + size,
+	}, nil
+}
+
+// close closes the segment being written. A later append starts a new one.
+func (s *spool) close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.closeActive()
+}
+
+// stats returns the number of bytes waiting in the spool and the number
+// of messages dropped so far
+func (s *spool) stats() (bytes int64, dropped uint64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.totalBytes(), s.dropped
+}
+
+// replaySpool sends the spooled messages in order, and stops at the
+// first failure
+func (shc *SnapHekaClient) replaySpool() error {
+	for {
+		records := shc.spool.head()
+		if len(records) == 0 {
+			return nil
+		}
+		frames := make([]hekaFrame, len(records))
+		for i, r := range records {
+			frames[i] = r.frame
+		}
+		pending, err := shc.sendFrames(frames)
+		if sent := len(frames) - len(pending); sent > 0 {
+			shc.spool.consume(records[sent-1].end)
+			logger.WithField("_block", "replaySpool").Info(
+				fmt.Sprintf("Sent %d spooled messages to Heka", sent))
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// spoolFrames keeps messages which could not be sent in the spool
+func (shc *SnapHekaClient) spoolFrames(frames []hekaFrame, cause error) error {
+	if err := shc.spool.append(frames); err != nil {
+		return fmt.Errorf("%d messages could not be sent to Heka (%v) nor spooled: %v",
+			len(frames), cause, err)
+	}
+	bytes, dropped := shc.spool.stats()
+	logger.WithField("_block", "spoolFrames").Warning(
+		fmt.Sprintf("Spooled %d messages, Heka is unreachable: %v (spool bytes=%d dropped=%d)",
+			len(frames), cause, bytes, dropped))
+	return nil
+}
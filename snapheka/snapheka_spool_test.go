@@ -0,0 +1,211 @@
+//
+// +build unit
+
+package snapheka
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/intelsdi-x/snap/core/ctypes"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func spoolTestFrames(n int) []hekaFrame {
+	frames := make([]hekaFrame, n)
+	for i := range frames {
+		frames[i] = hekaFrame{key: "intel.mock.foo", buf: []byte{0x1e, byte(i)}}
+	}
+	return frames
+}
+
+// drainSpool reads and consumes every record of the spool
+func drainSpool(s *spool) []hekaFrame {
+	var frames []hekaFrame
+	for records := s.head(); len(records) > 0; records = s.head() {
+		for _, r := range records {
+			frames = append(frames, r.frame)
+		}
+		s.consume(records[len(records)-1].end)
+	}
+	return frames
+}
+
+func spoolSegmentFiles(dir string) []string {
+	files, _ := filepath.Glob(filepath.Join(dir, "*"+spoolSuffix))
+	return files
+}
+
+func TestSpool(t *testing.T) {
+	Convey("Create a spool", t, func() {
+		dir, err := ioutil.TempDir("", "snapheka-spool")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		Convey("Invalid settings should be rejected", func() {
+			_, err := newSpool(dir, 100, 1000, 0, fsyncAlways)
+			So(err, ShouldNotBeNil)
+			_, err = newSpool(dir, 1000, 100, 0, "sometimes")
+			So(err, ShouldNotBeNil)
+			config := map[string]ctypes.ConfigValue{}
+			s, err := spoolFromConfig(config)
+			So(err, ShouldBeNil)
+			So(s, ShouldBeNil)
+		})
+		Convey("Messages should be read back in order across segments", func() {
+			s, err := newSpool(dir, 1000, 50, 0, fsyncAlways)
+			So(err, ShouldBeNil)
+			So(s.empty(), ShouldBeTrue)
+			So(s.append(spoolTestFrames(10)), ShouldBeNil)
+			So(len(spoolSegmentFiles(dir)), ShouldBeGreaterThan, 1)
+			So(s.empty(), ShouldBeFalse)
+			frames := drainSpool(s)
+			So(frames, ShouldResemble, spoolTestFrames(10))
+			So(s.empty(), ShouldBeTrue)
+			So(spoolSegmentFiles(dir), ShouldBeEmpty)
+		})
+		Convey("Partially sent segments should resume after the last sent message", func() {
+			s, err := newSpool(dir, 1000, 1000, 0, fsyncSegment)
+			So(err, ShouldBeNil)
+			So(s.append(spoolTestFrames(4)), ShouldBeNil)
+			records := s.head()
+			So(len(records), ShouldEqual, 4)
+			s.consume(records[1].end)
+			So(drainSpool(s), ShouldResemble, spoolTestFrames(4)[2:])
+		})
+		Convey("Segments should be found again after a restart", func() {
+			s, err := newSpool(dir, 1000, 50, 0, fsyncAlways)
+			So(err, ShouldBeNil)
+			So(s.append(spoolTestFrames(6)), ShouldBeNil)
+			s.mutex.Lock()
+			s.closeActive()
+			s.mutex.Unlock()
+			s, err = newSpool(dir, 1000, 50, 0, fsyncAlways)
+			So(err, ShouldBeNil)
+			So(s.append(spoolTestFrames(1)), ShouldBeNil)
+			So(drainSpool(s), ShouldResemble, append(spoolTestFrames(6), spoolTestFrames(1)...))
+		})
+		Convey("A corrupted record should be skipped", func() {
+			s, err := newSpool(dir, 1000, 1000, 0, fsyncAlways)
+			So(err, ShouldBeNil)
+			So(s.append(spoolTestFrames(4)), ShouldBeNil)
+			path := spoolSegmentFiles(dir)[0]
+			b, err := ioutil.ReadFile(path)
+			So(err, ShouldBeNil)
+			// flip a byte of the payload of the third record
+			recordSize := len(encodeSpoolRecord(spoolTestFrames(1)[0]))
+			b[2*recordSize+spoolHeaderSize+3] ^= 0xff
+			So(ioutil.WriteFile(path, b, 0600), ShouldBeNil)
+			frames := spoolTestFrames(4)
+			So(drainSpool(s), ShouldResemble, append(frames[:2], frames[3]))
+			So(s.empty(), ShouldBeTrue)
+		})
+		Convey("Records written after a torn write should still be read", func() {
+			s, err := newSpool(dir, 1000, 1000, 0, fsyncAlways)
+			So(err, ShouldBeNil)
+			So(s.append(spoolTestFrames(2)), ShouldBeNil)
+			// the first half of a record, as left by a failed write
+			rec := encodeSpoolRecord(spoolTestFrames(3)[2])
+			_, err = s.active.Write(rec[:len(rec)/2])
+			So(err, ShouldBeNil)
+			s.activeSegment().size += int64(len(rec) / 2)
+			So(s.append(spoolTestFrames(4)[3:]), ShouldBeNil)
+			frames := spoolTestFrames(4)
+			So(drainSpool(s), ShouldResemble, append(frames[:2], frames[3]))
+			So(s.empty(), ShouldBeTrue)
+		})
+		Convey("A closed spool should be appended to a new segment", func() {
+			s, err := newSpool(dir, 1000, 1000, 0, fsyncAlways)
+			So(err, ShouldBeNil)
+			So(s.append(spoolTestFrames(2)), ShouldBeNil)
+			s.close()
+			So(s.active, ShouldBeNil)
+			So(s.append(spoolTestFrames(3)[2:]), ShouldBeNil)
+			So(len(spoolSegmentFiles(dir)), ShouldEqual, 2)
+			So(drainSpool(s), ShouldResemble, spoolTestFrames(3))
+		})
+		Convey("A truncated segment should keep its complete records", func() {
+			s, err := newSpool(dir, 1000, 1000, 0, fsyncAlways)
+			So(err, ShouldBeNil)
+			So(s.append(spoolTestFrames(3)), ShouldBeNil)
+			path := spoolSegmentFiles(dir)[0]
+			fi, err := os.Stat(path)
+			So(err, ShouldBeNil)
+			So(os.Truncate(path, fi.Size()-1), ShouldBeNil)
+			So(drainSpool(s), ShouldResemble, spoolTestFrames(2))
+		})
+		Convey("The oldest segments should be dropped over the size limit", func() {
+			s, err := newSpool(dir, 100, 50, 0, fsyncNever)
+			So(err, ShouldBeNil)
+			So(s.append(spoolTestFrames(10)), ShouldBeNil)
+			bytes, dropped := s.stats()
+			So(bytes, ShouldBeLessThanOrEqualTo, 100)
+			So(dropped, ShouldBeGreaterThan, 0)
+			frames := drainSpool(s)
+			So(uint64(len(frames))+dropped, ShouldEqual, 10)
+			So(frames[len(frames)-1], ShouldResemble, spoolTestFrames(10)[9])
+		})
+		Convey("Segments should be dropped after the age limit", func() {
+			s, err := newSpool(dir, 1000, 1000, 20*time.Millisecond, fsyncAlways)
+			So(err, ShouldBeNil)
+			So(s.append(spoolTestFrames(3)), ShouldBeNil)
+			time.Sleep(40 * time.Millisecond)
+			So(s.empty(), ShouldBeTrue)
+			_, dropped := s.stats()
+			So(dropped, ShouldEqual, 3)
+			So(spoolSegmentFiles(dir), ShouldBeEmpty)
+		})
+	})
+}
+
+func TestHekaSpool(t *testing.T) {
+	defer hekaConns.closeAll()
+
+	Convey("Spool messages while Heka is down", t, func() {
+		dir, err := ioutil.TempDir("", "snapheka-spool")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		// reserve a port with nothing listening on it
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		addr := l.Addr().String()
+		l.Close()
+
+		shc, err := NewSnapHekaClient("tcp://"+addr, "")
+		So(err, ShouldBeNil)
+		shc.retry = retryPolicy{maxAttempts: 1}
+		shc.spool, err = newSpool(dir, dfltSpoolMaxBytes, dfltSpoolSegmentBytes, 0, fsyncAlways)
+		So(err, ShouldBeNil)
+		metrics := mockMetrics(5)
+		So(shc.sendToHeka(metrics[:3]), ShouldBeNil)
+		So(shc.spool.empty(), ShouldBeFalse)
+
+		Convey("Spooled messages should be sent first once Heka is back", func() {
+			l, err := net.Listen("tcp", addr)
+			So(err, ShouldBeNil)
+			defer l.Close()
+			received := readAll(l)
+			So(shc.sendToHeka(metrics[3:]), ShouldBeNil)
+			So(shc.spool.empty(), ShouldBeTrue)
+			hekaConns.closeAll()
+			b := <-received
+			for i := 0; i < len(metrics); i++ {
+				header, msg, err := decodeFrame(b)
+				So(err, ShouldBeNil)
+				So(msg.FindFirstField("value").GetValue(), ShouldEqual, int64(i))
+				b = b[3+int(b[1])+int(header.GetMessageLength()):]
+			}
+			So(b, ShouldBeEmpty)
+		})
+		Convey("Closing the client should close the spool segment", func() {
+			So(shc.spool.active, ShouldNotBeNil)
+			shc.close()
+			So(shc.spool.active, ShouldBeNil)
+		})
+	})
+}
@@ -0,0 +1,172 @@
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2016 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package snapheka
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/intelsdi-x/snap/core/ctypes"
+)
+
+const (
+	// Prefixes of the config keys of single static fields
+	staticFieldKey    = "field."
+	staticFieldRepKey = "field-representation."
+
+	// Types of the static fields
+	staticTypeString  = "string"
+	staticTypeInteger = "integer"
+	staticTypeDouble  = "double"
+	staticTypeBool    = "bool"
+)
+
+// staticField is a constant field added to every message of a task
+type staticField struct {
+	name           string
+	value          interface{}
+	representation string
+}
+
+// staticFieldsFromConfig reads the static fields of the static-fields JSON
+// object and of the field.<name> keys, sorted by name. In the JSON object
+// a field is either a value, or an object with the value, its type and
+// representation, e.g. {"env": "prod", "cores": {"value": 8, "type":
+// "double", "representation": "count"}}. The representation of a
+// field.<name> field is given by field-representation.<name>.
+func staticFieldsFromConfig(config map[string]ctypes.ConfigValue) ([]staticField, error) {
+	fields := make(map[string]staticField)
+
+	if s := configString(config, "static-fields", ""); len(s) > 0 {
+		var object map[string]interface{}
+		d := json.NewDecoder(bytes.NewReader([]byte(s)))
+		d.UseNumber()
+		if err := d.Decode(&object); err != nil {
+			return nil, fmt.Errorf("static-fields must be a JSON object: %v", err)
+		}
+		for name, v := range object {
+			sf := staticField{name: name}
+			typ := ""
+			if spec, ok := v.(map[string]interface{}); ok {
+				for k := range spec {
+					if k != "value" && k != "type" && k != "representation" {
+						return nil, fmt.Errorf("static field %s: unknown key '%s' (should be one of value type representation)", name, k)
+					}
+				}
+				v = spec["value"]
+				typ, _ = spec["type"].(string)
+				sf.representation, _ = spec["representation"].(string)
+			}
+			value, err := staticValue(v, typ)
+			if err != nil {
+				return nil, fmt.Errorf("static field %s: %v", name, err)
+			}
+			sf.value = value
+			fields[name] = sf
+		}
+	}
+
+	for key, cv := range config {
+		if !strings.HasPrefix(key, staticFieldKey) {
+			continue
+		}
+		name := strings.TrimPrefix(key, staticFieldKey)
+		if _, ok := fields[name]; ok {
+			return nil, fmt.Errorf("static field %s is set by both static-fields and %s", name, key)
+		}
+		sf := staticField{name: name, representation: configString(config, staticFieldRepKey+name, "")}
+		switch v := cv.(type) {
+		case ctypes.ConfigValueStr:
+			sf.value = v.Value
+		case ctypes.ConfigValueInt:
+			sf.value = int64(v.Value)
+		case ctypes.ConfigValueFloat:
+			sf.value = v.Value
+		case ctypes.ConfigValueBool:
+			sf.value = v.Value
+		default:
+			return nil, fmt.Errorf("static field %s: %T value is not supported", name, cv)
+		}
+		fields[name] = sf
+	}
+	for key := range config {
+		if name := strings.TrimPrefix(key, staticFieldRepKey); name != key {
+			if _, ok := config[staticFieldKey+name]; !ok {
+				return nil, fmt.Errorf("%s is set without %s%s", key, staticFieldKey, name)
+			}
+		}
+	}
+
+	var sorted []staticField
+	for name, sf := range fields {
+		if len(name) == 0 {
+			return nil, fmt.Errorf("static field names must not be empty")
+		}
+		sorted = append(sorted, sf)
+	}
+	sort.Sort(byStaticName(sorted))
+	return sorted, nil
+}
+
+type byStaticName []staticField
+
+func (s byStaticName) Len() int           { return len(s) }
+func (s byStaticName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byStaticName) Less(i, j int) bool { return s[i].name < s[j].name }
+
+// staticValue converts a JSON value into a Heka field value of type typ,
+// or of the type of the JSON value when typ is empty
+func staticValue(v interface{}, typ string) (interface{}, error) {
+	switch v.(type) {
+	case string, bool, json.Number:
+	case nil:
+		return nil, fmt.Errorf("no value")
+	default:
+		return nil, fmt.Errorf("value must be a string, a number or a boolean")
+	}
+	s := fmt.Sprint(v)
+	switch typ {
+	case "":
+		switch d := v.(type) {
+		case json.Number:
+			if n, err := d.Int64(); err == nil {
+				return n, nil
+			}
+			return d.Float64()
+		default:
+			return d, nil
+		}
+	case staticTypeString:
+		return s, nil
+	case staticTypeInteger:
+		return strconv.ParseInt(s, 10, 64)
+	case staticTypeDouble:
+		return strconv.ParseFloat(s, 64)
+	case staticTypeBool:
+		return strconv.ParseBool(s)
+	default:
+		return nil, fmt.Errorf("unknown type '%s' (should be one of %s %s %s %s)",
+			typ, staticTypeString, staticTypeInteger, staticTypeDouble, staticTypeBool)
+	}
+}
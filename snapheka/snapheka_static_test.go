@@ -0,0 +1,116 @@
+//
+// +build unit
+
+package snapheka
+
+import (
+	"testing"
+	"time"
+
+	"github.com/intelsdi-x/snap/control/plugin"
+	"github.com/intelsdi-x/snap/core"
+	"github.com/intelsdi-x/snap/core/ctypes"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestStaticFields(t *testing.T) {
+	Convey("Configure static fields", t, func() {
+		config := map[string]ctypes.ConfigValue{}
+
+		Convey("No static field should be set by default", func() {
+			fields, err := staticFieldsFromConfig(config)
+			So(err, ShouldBeNil)
+			So(fields, ShouldBeEmpty)
+		})
+		Convey("Fields of the JSON object should keep their JSON type", func() {
+			config["static-fields"] = ctypes.ConfigValueStr{Value: `{"env": "prod", "cores": 8, "load": 0.5, "primary": true}`}
+			fields, err := staticFieldsFromConfig(config)
+			So(err, ShouldBeNil)
+			So(fields, ShouldResemble, []staticField{
+				{name: "cores", value: int64(8)},
+				{name: "env", value: "prod"},
+				{name: "load", value: 0.5},
+				{name: "primary", value: true},
+			})
+		})
+		Convey("Fields of the JSON object should take their type and representation", func() {
+			config["static-fields"] = ctypes.ConfigValueStr{Value: `{"cores": {"value": 8, "type": "double", "representation": "count"}, "rack": {"value": 12, "type": "string"}}`}
+			fields, err := staticFieldsFromConfig(config)
+			So(err, ShouldBeNil)
+			So(fields, ShouldResemble, []staticField{
+				{name: "cores", value: 8.0, representation: "count"},
+				{name: "rack", value: "12"},
+			})
+		})
+		Convey("Invalid JSON objects should be rejected", func() {
+			for _, s := range []string{`["env"]`, `{"env": null}`, `{"env": [1]}`, `{"env": {"value": 1, "type": "uint"}}`,
+				`{"env": {"value": "x", "type": "integer"}}`, `{"env": {"value": 1, "unit": "B"}}`} {
+				config["static-fields"] = ctypes.ConfigValueStr{Value: s}
+				_, err := staticFieldsFromConfig(config)
+				So(err, ShouldNotBeNil)
+			}
+		})
+		Convey("field.<name> keys should add single fields", func() {
+			config["field.dc"] = ctypes.ConfigValueStr{Value: "ams1"}
+			config["field.cores"] = ctypes.ConfigValueInt{Value: 8}
+			config["field-representation.cores"] = ctypes.ConfigValueStr{Value: "count"}
+			fields, err := staticFieldsFromConfig(config)
+			So(err, ShouldBeNil)
+			So(fields, ShouldResemble, []staticField{
+				{name: "cores", value: int64(8), representation: "count"},
+				{name: "dc", value: "ams1"},
+			})
+		})
+		Convey("A field set twice or a lone representation should be rejected", func() {
+			config["static-fields"] = ctypes.ConfigValueStr{Value: `{"dc": "ams1"}`}
+			config["field.dc"] = ctypes.ConfigValueStr{Value: "ams2"}
+			_, err := staticFieldsFromConfig(config)
+			So(err, ShouldNotBeNil)
+			delete(config, "field.dc")
+			config["field-representation.dc"] = ctypes.ConfigValueStr{Value: "site"}
+			_, err = staticFieldsFromConfig(config)
+			So(err, ShouldNotBeNil)
+		})
+		Convey("Static fields named like a field of the plugin should be rejected", func() {
+			config["field.timestamp"] = ctypes.ConfigValueInt{Value: 0}
+			_, err := fieldOptionsFromConfig(config)
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Add static fields to Heka messages", t, func() {
+		opts := newFieldOptions()
+		opts.staticFields = []staticField{
+			{name: "dc", value: "ams1"},
+			{name: "env", value: "prod", representation: "stage"},
+		}
+		m := *plugin.NewMetricType(core.NewNamespace("intel", "mock", "foo"), time.Now(), map[string]string{"dc": "fra1"}, "", 1)
+
+		Convey("Static fields should be added with their representation", func() {
+			msg, err := createHekaMessage("", m, 1, "localhost", opts)
+			So(err, ShouldBeNil)
+			So(msg.FindFirstField("env").GetValue(), ShouldEqual, "prod")
+			So(msg.FindFirstField("env").GetRepresentation(), ShouldEqual, "stage")
+			So(msg.FindFirstField("dimensions").GetValueString(), ShouldResemble, []string{"dc"})
+		})
+		Convey("Tags should win over static fields of the same name", func() {
+			msg, err := createHekaMessage("", m, 1, "localhost", opts)
+			So(err, ShouldBeNil)
+			So(msg.FindFirstField("dc").GetValue(), ShouldEqual, "fra1")
+			n := 0
+			for _, f := range msg.GetFields() {
+				if f.GetName() == "dc" {
+					n++
+				}
+			}
+			So(n, ShouldEqual, 1)
+		})
+		Convey("Static fields should be listed in dimensions when enabled", func() {
+			opts.staticDimensions = true
+			msg, err := createHekaMessage("", m, 1, "localhost", opts)
+			So(err, ShouldBeNil)
+			So(msg.FindFirstField("dimensions").GetValueString(), ShouldResemble, []string{"dc", "env"})
+		})
+	})
+}
@@ -4,9 +4,16 @@
 package snapheka
 
 import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
+	"github.com/mozilla-services/heka/message"
+
 	"github.com/intelsdi-x/snap/control/plugin"
 	"github.com/intelsdi-x/snap/control/plugin/cpolicy"
 	"github.com/intelsdi-x/snap/core"
@@ -86,7 +93,7 @@ func TestHekaPlugin(t *testing.T) {
 				Value:       "baz"}
 			namespace = append(namespace, staElt)
 			metric := *plugin.NewMetricType(namespace, time.Now(), tags, "some unit", 3.141)
-			message, _ := createHekaMessage("some payload", metric, 1234, "host0")
+			message, _ := createHekaMessage("some payload", metric, 1234, "host0", newFieldOptions())
 			Convey("The Heka message should not be nil", func() {
 				So(message, ShouldNotBeNil)
 			})
@@ -101,12 +108,13 @@ func TestHekaPlugin(t *testing.T) {
 				So(fields, ShouldNotBeNil)
 				So(fields[0].GetName(), ShouldEqual, "bar")
 				So(fields[0].GetValue(), ShouldEqual, "bar_val")
-				So(fields[1].GetName(), ShouldEqual, "name")
+				// name is reserved for the metric name
+				So(fields[1].GetName(), ShouldEqual, "dimension_name")
 				So(fields[1].GetValue(), ShouldEqual, "name_val")
 				So(fields[2].GetName(), ShouldEqual, "tag_key")
 				So(fields[2].GetValue(), ShouldEqual, "tag_val")
 				So(fields[3].GetName(), ShouldEqual, "dimensions")
-				So(fields[3].GetValueString(), ShouldResemble, []string{"bar", "name", "tag_key"})
+				So(fields[3].GetValueString(), ShouldResemble, []string{"bar", "dimension_name", "tag_key"})
 				So(fields[4].GetName(), ShouldEqual, "name")
 				So(fields[4].GetValue(), ShouldEqual, "foo.baz")
 				So(fields[5].GetName(), ShouldEqual, "value")
@@ -116,3 +124,144 @@ func TestHekaPlugin(t *testing.T) {
 		})
 	})
 }
+
+func TestHekaUDP(t *testing.T) {
+	defer hekaConns.closeAll()
+
+	Convey("Send metrics to a Heka UdpInput", t, func() {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		defer pc.Close()
+		shc, err := NewSnapHekaClient("udp://"+pc.LocalAddr().String(), "")
+		So(err, ShouldBeNil)
+		metrics := []plugin.MetricType{
+			*plugin.NewMetricType(core.NewNamespace("intel", "mock", "foo"), time.Now(), nil, "", 1),
+		}
+
+		Convey("Each message should be sent as one datagram", func() {
+			So(shc.sendToHeka(metrics), ShouldBeNil)
+			buf := make([]byte, SnapDfltUDPMaxSize)
+			pc.SetReadDeadline(time.Now().Add(time.Second))
+			n, _, err := pc.ReadFrom(buf)
+			So(err, ShouldBeNil)
+			So(n, ShouldBeGreaterThan, 0)
+			So(buf[0], ShouldEqual, 0x1e)
+		})
+		Convey("A message larger than udp-max-size should be rejected", func() {
+			shc.udpMaxSize = 16
+			err := shc.sendToHeka(metrics)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "does not fit in a udp datagram")
+		})
+	})
+}
+
+func TestHekaUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapheka-unix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer hekaConns.closeAll()
+	metrics := []plugin.MetricType{
+		*plugin.NewMetricType(core.NewNamespace("intel", "mock", "foo"), time.Now(), nil, "", 1),
+	}
+
+	Convey("Send metrics to a unix stream socket", t, func() {
+		path := filepath.Join(dir, "heka.sock")
+		l, err := net.Listen("unix", path)
+		So(err, ShouldBeNil)
+		defer l.Close()
+		received := make(chan []byte, 1)
+		go func() {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+			b := make([]byte, 1)
+			c.Read(b)
+			received <- b
+		}()
+		shc, err := NewSnapHekaClient("unix://"+path, "")
+		So(err, ShouldBeNil)
+		So(shc.hekaHosts, ShouldResemble, []string{path})
+		So(shc.sendToHeka(metrics), ShouldBeNil)
+		So(<-received, ShouldResemble, []byte{0x1e})
+	})
+
+	Convey("Send metrics to a unix datagram socket", t, func() {
+		path := filepath.Join(dir, "heka.dgram")
+		pc, err := net.ListenPacket("unixgram", path)
+		So(err, ShouldBeNil)
+		defer pc.Close()
+		shc, err := NewSnapHekaClient("unixgram://"+path, "")
+		So(err, ShouldBeNil)
+		So(shc.sendToHeka(metrics), ShouldBeNil)
+		buf := make([]byte, SnapDfltUDPMaxSize)
+		pc.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := pc.ReadFrom(buf)
+		So(err, ShouldBeNil)
+		So(n, ShouldBeGreaterThan, 0)
+		So(buf[0], ShouldEqual, 0x1e)
+	})
+
+	Convey("Build the Heka address from config", t, func() {
+		config := make(map[string]ctypes.ConfigValue)
+
+		Convey("host and port should give a tcp address", func() {
+			config["host"] = ctypes.ConfigValueStr{Value: "localhost"}
+			config["port"] = ctypes.ConfigValueInt{Value: 5565}
+			addr, err := hekaAddress(config, false)
+			So(err, ShouldBeNil)
+			So(addr, ShouldEqual, "tcp://localhost:5565")
+			addr, err = hekaAddress(config, true)
+			So(err, ShouldBeNil)
+			So(addr, ShouldEqual, "tls://localhost:5565")
+		})
+		Convey("socket-path should give a unix socket address", func() {
+			config["socket-path"] = ctypes.ConfigValueStr{Value: "/var/run/heka.sock"}
+			addr, err := hekaAddress(config, false)
+			So(err, ShouldBeNil)
+			So(addr, ShouldEqual, "unix:///var/run/heka.sock")
+			config["protocol"] = ctypes.ConfigValueStr{Value: "udp"}
+			addr, err = hekaAddress(config, false)
+			So(err, ShouldBeNil)
+			So(addr, ShouldEqual, "unixgram:///var/run/heka.sock")
+			_, err = hekaAddress(config, true)
+			So(err, ShouldNotBeNil)
+		})
+		Convey("A missing address should be an error", func() {
+			_, err := hekaAddress(config, false)
+			So(err, ShouldNotBeNil)
+			config["socket-path"] = ctypes.ConfigValueStr{Value: "/var/run/heka.sock"}
+			config["protocol"] = ctypes.ConfigValueStr{Value: "sctp"}
+			_, err = hekaAddress(config, false)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+// decodeFrame splits a framed Heka message into its header and message
+func decodeFrame(b []byte) (*message.Header, *message.Message, error) {
+	if len(b) < 3 || b[0] != message.RECORD_SEPARATOR {
+		return nil, nil, fmt.Errorf("missing record separator")
+	}
+	hlen := int(b[1])
+	if len(b) < hlen+3 || b[hlen+2] != message.UNIT_SEPARATOR {
+		return nil, nil, fmt.Errorf("missing unit separator")
+	}
+	header := &message.Header{}
+	if err := header.Unmarshal(b[2 : hlen+2]); err != nil {
+		return nil, nil, err
+	}
+	mlen := int(header.GetMessageLength())
+	if len(b) < hlen+3+mlen {
+		return nil, nil, fmt.Errorf("truncated message")
+	}
+	msg := &message.Message{}
+	if err := msg.Unmarshal(b[hlen+3 : hlen+3+mlen]); err != nil {
+		return nil, nil, err
+	}
+	return header, msg, nil
+}
@@ -0,0 +1,80 @@
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2016 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package snapheka
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	dfltConnectTimeout = 5 * time.Second
+	dfltWriteTimeout   = 5 * time.Second
+	// Connections are kept open whatever their idle time by default
+	dfltIdleTimeout = time.Duration(0)
+)
+
+// TimeoutError is returned when Heka does not accept a connection or a
+// write in time, e.g. when hekad is stalled. Sending can be retried later.
+type TimeoutError struct {
+	// Op is "connect" or "write"
+	Op       string
+	Addr     string
+	Duration time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("timeout: %s to Heka at %s did not complete within %v", e.Op, e.Addr, e.Duration)
+}
+
+// Timeout tells that the error is a timeout, as for a net.Error
+func (e *TimeoutError) Timeout() bool { return true }
+
+// Temporary tells that sending can be retried, as for a net.Error
+func (e *TimeoutError) Temporary() bool { return true }
+
+// SendError is returned by Publish when messages could not be sent to Heka
+// after all the attempts. Err is the last error met.
+type SendError struct {
+	Pending  int
+	Total    int
+	Addr     string
+	Attempts int
+	Err      error
+}
+
+func (e *SendError) Error() string {
+	return fmt.Sprintf("%d of %d messages could not be sent to Heka at %s after %d attempts: %v",
+		e.Pending, e.Total, e.Addr, e.Attempts, e.Err)
+}
+
+// Timeout tells whether sending failed because of a timeout
+func (e *SendError) Timeout() bool { return isTimeout(e.Err) }
+
+// Temporary tells whether sending can be retried later, which is the case
+// after a timeout
+func (e *SendError) Temporary() bool { return e.Timeout() }
+
+// isTimeout tells whether err is a network timeout
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
@@ -0,0 +1,100 @@
+//
+// +build unit
+
+package snapheka
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/intelsdi-x/snap/core/ctypes"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestHekaTimeouts(t *testing.T) {
+	defer hekaConns.closeAll()
+
+	Convey("Configure the timeouts", t, func() {
+		config := map[string]ctypes.ConfigValue{
+			"host": ctypes.ConfigValueStr{Value: "localhost"},
+			"port": ctypes.ConfigValueInt{Value: 5565},
+		}
+
+		Convey("Defaults should be used when not set", func() {
+			shc, err := newClientFromConfig(config)
+			So(err, ShouldBeNil)
+			So(shc.connectTimeout, ShouldEqual, dfltConnectTimeout)
+			So(shc.writeTimeout, ShouldEqual, dfltWriteTimeout)
+			So(shc.idleTimeout, ShouldEqual, dfltIdleTimeout)
+		})
+		Convey("Configured timeouts should be applied", func() {
+			config["connect-timeout"] = ctypes.ConfigValueStr{Value: "1s"}
+			config["write-timeout"] = ctypes.ConfigValueStr{Value: "250ms"}
+			config["idle-timeout"] = ctypes.ConfigValueStr{Value: "1m"}
+			shc, err := newClientFromConfig(config)
+			So(err, ShouldBeNil)
+			So(shc.connectTimeout, ShouldEqual, time.Second)
+			So(shc.writeTimeout, ShouldEqual, 250*time.Millisecond)
+			So(shc.idleTimeout, ShouldEqual, time.Minute)
+		})
+		Convey("Invalid timeouts should be rejected", func() {
+			config["write-timeout"] = ctypes.ConfigValueStr{Value: "soon"}
+			_, err := newClientFromConfig(config)
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Send to a stalled Heka", t, func() {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		defer l.Close()
+		// connections are accepted but never read from
+		accepted := acceptAll(l)
+		defer func() {
+			l.Close()
+			for c := range accepted {
+				c.Close()
+			}
+		}()
+
+		Convey("A stalled TLS handshake should fail with a connect timeout", func() {
+			shc, err := NewSnapHekaClient("tls://"+l.Addr().String(), "")
+			So(err, ShouldBeNil)
+			shc.connectTimeout = 50 * time.Millisecond
+			_, err = shc.dialer(l.Addr().String())()
+			So(err, ShouldHaveSameTypeAs, &TimeoutError{})
+			So(err.(*TimeoutError).Op, ShouldEqual, "connect")
+		})
+		Convey("A stalled write should fail with a write timeout", func() {
+			shc, err := NewSnapHekaClient("tcp://"+l.Addr().String(), "")
+			So(err, ShouldBeNil)
+			shc.writeTimeout = 50 * time.Millisecond
+			// large enough to fill the socket buffers
+			buf := make([]byte, 64*1024*1024)
+			start := time.Now()
+			err = shc.sendMessage(l.Addr().String(), buf)
+			So(time.Since(start), ShouldBeLessThan, 5*time.Second)
+			So(err, ShouldHaveSameTypeAs, &TimeoutError{})
+			So(err.(*TimeoutError).Op, ShouldEqual, "write")
+		})
+	})
+
+	Convey("Report send errors", t, func() {
+		Convey("A timeout should be retryable", func() {
+			err := &SendError{Pending: 1, Total: 2, Addr: "tcp://localhost:5565", Attempts: 3,
+				Err: &TimeoutError{Op: "write", Addr: "tcp://localhost:5565", Duration: time.Second}}
+			So(err.Timeout(), ShouldBeTrue)
+			So(err.Temporary(), ShouldBeTrue)
+			So(err.Error(), ShouldContainSubstring, "timeout: write to Heka")
+		})
+		Convey("Other errors should not be reported as timeouts", func() {
+			err := &SendError{Pending: 1, Total: 2, Addr: "tcp://localhost:5565", Attempts: 3,
+				Err: errors.New("connection refused")}
+			So(err.Timeout(), ShouldBeFalse)
+			So(err.Temporary(), ShouldBeFalse)
+		})
+	})
+}
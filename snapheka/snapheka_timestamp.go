@@ -0,0 +1,135 @@
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2016 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package snapheka
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+
+	"github.com/intelsdi-x/snap/control/plugin"
+	"github.com/intelsdi-x/snap/core/ctypes"
+)
+
+const (
+	// Sources of the Timestamp of the Heka messages
+	tsSourcePublish    = "publish"
+	tsSourceCollection = "collection"
+	tsSourceBoth       = "both"
+
+	// What to do with zero or future collection timestamps
+	tsInvalidPublish = "publish"
+	tsInvalidKeep    = "keep"
+	tsInvalidReject  = "reject"
+
+	dfltTimestampSource    = tsSourcePublish
+	dfltTimestampInvalid   = tsInvalidPublish
+	dfltTimestampMaxFuture = time.Minute
+)
+
+// timestampPolicy defines which time the Timestamp of the Heka messages is,
+// and how metrics with an invalid collection time are handled
+type timestampPolicy struct {
+	source  string
+	invalid string
+	// How far ahead of the publish time a collection time may be
+	maxFuture time.Duration
+}
+
+func newTimestampPolicy() timestampPolicy {
+	return timestampPolicy{
+		source:    dfltTimestampSource,
+		invalid:   dfltTimestampInvalid,
+		maxFuture: dfltTimestampMaxFuture,
+	}
+}
+
+// timestampPolicyFromConfig builds the timestamp policy from the task
+// config, using the defaults for the keys which are not set
+func timestampPolicyFromConfig(config map[string]ctypes.ConfigValue) (timestampPolicy, error) {
+	tp := newTimestampPolicy()
+	var err error
+	tp.source = configString(config, "timestamp-source", tp.source)
+	switch tp.source {
+	case tsSourcePublish, tsSourceCollection, tsSourceBoth:
+	default:
+		return tp, fmt.Errorf("unknown timestamp-source '%s' (should be one of %s %s %s)",
+			tp.source, tsSourcePublish, tsSourceCollection, tsSourceBoth)
+	}
+	tp.invalid = configString(config, "timestamp-invalid", tp.invalid)
+	switch tp.invalid {
+	case tsInvalidPublish, tsInvalidKeep, tsInvalidReject:
+	default:
+		return tp, fmt.Errorf("unknown timestamp-invalid '%s' (should be one of %s %s %s)",
+			tp.invalid, tsInvalidPublish, tsInvalidKeep, tsInvalidReject)
+	}
+	if tp.maxFuture, err = configDuration(config, "timestamp-max-future", tp.maxFuture); err != nil {
+		return tp, err
+	}
+	return tp, nil
+}
+
+// apply sets the Timestamp of a Heka message created at publish time from
+// the collection time of its metric, depending on the policy source.
+// A collection time which is zero, before the Unix epoch or too far in the
+// future is replaced by the publish time or rejected, in the message
+// Timestamp and in the timestamp field. The publish_timestamp field is left
+// out when the field filter of opts does not allow it. With the default
+// policy the message is left as it is.
+func (tp timestampPolicy) apply(msg *message.Message, m plugin.MetricType, opts fieldOptions) error {
+	if tp.source == tsSourcePublish && tp.invalid != tsInvalidReject {
+		// the collection time only ends up in the timestamp field
+		return nil
+	}
+	published := time.Unix(0, msg.GetTimestamp())
+	collected := m.Timestamp()
+
+	var problem string
+	switch {
+	case collected.IsZero() || collected.UnixNano() <= 0:
+		problem = "is not set"
+	case collected.After(published.Add(tp.maxFuture)):
+		problem = fmt.Sprintf("is %v in the future", collected.Sub(published))
+	}
+	if len(problem) > 0 {
+		switch tp.invalid {
+		case tsInvalidReject:
+			return fmt.Errorf("collection time of metric %s %s", namespaceString(m), problem)
+		case tsInvalidPublish:
+			logger.WithField("_block", "timestampPolicy").Debug(
+				fmt.Sprintf("collection time of metric %s %s, using the publish time",
+					namespaceString(m), problem))
+			collected = published
+			if f := msg.FindFirstField("timestamp"); f != nil {
+				msg.DeleteField(f)
+				addField("timestamp", collected.UnixNano(), msg)
+			}
+		}
+	}
+
+	if tp.source == tsSourceCollection || tp.source == tsSourceBoth {
+		msg.SetTimestamp(collected.UnixNano())
+	}
+	if tp.source == tsSourceBoth && opts.fieldFilter.allows("publish_timestamp") {
+		addField("publish_timestamp", published.UnixNano(), msg)
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+//
+// +build unit
+
+package snapheka
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+
+	"github.com/intelsdi-x/snap/control/plugin"
+	"github.com/intelsdi-x/snap/core"
+	"github.com/intelsdi-x/snap/core/ctypes"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// messageAt creates the Heka message of a metric collected at ts
+func messageAt(ts time.Time) (*message.Message, plugin.MetricType) {
+	m := *plugin.NewMetricType(core.NewNamespace("intel", "mock", "foo"), ts, nil, "", 1)
+	msg, err := createHekaMessage("", m, 1, "localhost", newFieldOptions())
+	So(err, ShouldBeNil)
+	return msg, m
+}
+
+func TestTimestampPolicy(t *testing.T) {
+	Convey("Configure the timestamp policy", t, func() {
+		config := map[string]ctypes.ConfigValue{}
+
+		Convey("Defaults should be used when not set", func() {
+			tp, err := timestampPolicyFromConfig(config)
+			So(err, ShouldBeNil)
+			So(tp, ShouldResemble, newTimestampPolicy())
+		})
+		Convey("Invalid settings should be rejected", func() {
+			config["timestamp-source"] = ctypes.ConfigValueStr{Value: "snap"}
+			_, err := timestampPolicyFromConfig(config)
+			So(err, ShouldNotBeNil)
+			config["timestamp-source"] = ctypes.ConfigValueStr{Value: tsSourceBoth}
+			config["timestamp-invalid"] = ctypes.ConfigValueStr{Value: "fix"}
+			_, err = timestampPolicyFromConfig(config)
+			So(err, ShouldNotBeNil)
+			config["timestamp-invalid"] = ctypes.ConfigValueStr{Value: tsInvalidKeep}
+			config["timestamp-max-future"] = ctypes.ConfigValueStr{Value: "-1m"}
+			_, err = timestampPolicyFromConfig(config)
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Set the Timestamp of Heka messages", t, func() {
+		tp := newTimestampPolicy()
+		opts := newFieldOptions()
+		collected := time.Now().Add(-time.Hour)
+
+		Convey("publish should keep the publish time", func() {
+			msg, m := messageAt(collected)
+			published := msg.GetTimestamp()
+			So(tp.apply(msg, m, opts), ShouldBeNil)
+			So(msg.GetTimestamp(), ShouldEqual, published)
+			So(msg.FindFirstField("timestamp").GetValue(), ShouldEqual, collected.UnixNano())
+			So(msg.FindFirstField("publish_timestamp"), ShouldBeNil)
+		})
+		Convey("The default policy should leave an unset collection time as it is", func() {
+			msg, m := messageAt(time.Time{})
+			published := msg.GetTimestamp()
+			timestamp := msg.FindFirstField("timestamp").GetValue()
+			So(tp.apply(msg, m, opts), ShouldBeNil)
+			So(msg.GetTimestamp(), ShouldEqual, published)
+			So(msg.FindFirstField("timestamp").GetValue(), ShouldEqual, timestamp)
+		})
+		Convey("collection should use the collection time", func() {
+			tp.source = tsSourceCollection
+			msg, m := messageAt(collected)
+			So(tp.apply(msg, m, opts), ShouldBeNil)
+			So(msg.GetTimestamp(), ShouldEqual, collected.UnixNano())
+			So(msg.FindFirstField("publish_timestamp"), ShouldBeNil)
+		})
+		Convey("both should keep the publish time in a field", func() {
+			tp.source = tsSourceBoth
+			msg, m := messageAt(collected)
+			published := msg.GetTimestamp()
+			So(tp.apply(msg, m, opts), ShouldBeNil)
+			So(msg.GetTimestamp(), ShouldEqual, collected.UnixNano())
+			So(msg.FindFirstField("publish_timestamp").GetValue(), ShouldEqual, published)
+		})
+		Convey("publish_timestamp should pass the field filter", func() {
+			tp.source = tsSourceBoth
+			opts.fieldFilter.exclude = []string{"publish_*"}
+			msg, m := messageAt(collected)
+			So(tp.apply(msg, m, opts), ShouldBeNil)
+			So(msg.GetTimestamp(), ShouldEqual, collected.UnixNano())
+			So(msg.FindFirstField("publish_timestamp"), ShouldBeNil)
+		})
+		Convey("A zero collection time should be replaced by the publish time", func() {
+			tp.source = tsSourceCollection
+			msg, m := messageAt(time.Time{})
+			published := msg.GetTimestamp()
+			So(tp.apply(msg, m, opts), ShouldBeNil)
+			So(msg.GetTimestamp(), ShouldEqual, published)
+			So(msg.FindFirstField("timestamp").GetValue(), ShouldEqual, published)
+			So(len(msg.GetFields()), ShouldEqual, 3)
+		})
+		Convey("A future collection time should be rejected", func() {
+			tp.source = tsSourceCollection
+			tp.invalid = tsInvalidReject
+			msg, m := messageAt(time.Now().Add(time.Hour))
+			err := tp.apply(msg, m, opts)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "in the future")
+			msg, m = messageAt(time.Now().Add(time.Second))
+			So(tp.apply(msg, m, opts), ShouldBeNil)
+		})
+		Convey("An invalid collection time should be kept when asked", func() {
+			tp.source = tsSourceCollection
+			tp.invalid = tsInvalidKeep
+			future := time.Now().Add(time.Hour)
+			msg, m := messageAt(future)
+			So(tp.apply(msg, m, opts), ShouldBeNil)
+			So(msg.GetTimestamp(), ShouldEqual, future.UnixNano())
+		})
+	})
+}
@@ -0,0 +1,83 @@
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2016 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package snapheka
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/intelsdi-x/snap/core/ctypes"
+)
+
+const dfltTLSMinVersion = "1.2"
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+}
+
+// tlsConfigFromConfig builds the TLS configuration used to connect to
+// a Heka TcpInput with use_tls enabled. It returns nil when use-tls is
+// not set in the task config.
+func tlsConfigFromConfig(config map[string]ctypes.ConfigValue) (*tls.Config, error) {
+	if !configBool(config, "use-tls", false) {
+		return nil, nil
+	}
+
+	minVersion := configString(config, "tls-min-version", dfltTLSMinVersion)
+	version, ok := tlsVersions[minVersion]
+	if !ok {
+		return nil, fmt.Errorf("tls-min-version %q is not supported (should be one of 1.0 1.1 1.2)", minVersion)
+	}
+	tlsConfig := &tls.Config{
+		ServerName:         configString(config, "tls-server-name", ""),
+		InsecureSkipVerify: configBool(config, "tls-insecure-skip-verify", false),
+		MinVersion:         version,
+	}
+
+	if caFile := configString(config, "tls-ca-file", ""); len(caFile) > 0 {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading tls-ca-file %s: %v", caFile, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no PEM certificate found in tls-ca-file %s", caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	certFile := configString(config, "tls-cert-file", "")
+	keyFile := configString(config, "tls-key-file", "")
+	if len(certFile) > 0 || len(keyFile) > 0 {
+		if len(certFile) == 0 || len(keyFile) == 0 {
+			return nil, fmt.Errorf("tls-cert-file and tls-key-file must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate %s: %v", certFile, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
@@ -0,0 +1,204 @@
+//
+// +build unit
+
+package snapheka
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/intelsdi-x/snap/control/plugin"
+	"github.com/intelsdi-x/snap/core"
+	"github.com/intelsdi-x/snap/core/ctypes"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// writeSelfSignedCert writes a self-signed certificate valid for
+// localhost/127.0.0.1 and its key as PEM files into dir
+func writeSelfSignedCert(dir string) (certFile, keyFile string, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return "", "", err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return "", "", err
+	}
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if err != nil {
+		return "", "", err
+	}
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return certFile, keyFile, err
+}
+
+func TestHekaTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapheka-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile, err := writeSelfSignedCert(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hekaConns.closeAll()
+
+	Convey("Build the TLS configuration", t, func() {
+		config := make(map[string]ctypes.ConfigValue)
+
+		Convey("TLS should be disabled by default", func() {
+			tlsConfig, err := tlsConfigFromConfig(config)
+			So(err, ShouldBeNil)
+			So(tlsConfig, ShouldBeNil)
+		})
+		Convey("TLS options should be applied", func() {
+			config["use-tls"] = ctypes.ConfigValueBool{Value: true}
+			config["tls-ca-file"] = ctypes.ConfigValueStr{Value: certFile}
+			config["tls-cert-file"] = ctypes.ConfigValueStr{Value: certFile}
+			config["tls-key-file"] = ctypes.ConfigValueStr{Value: keyFile}
+			config["tls-server-name"] = ctypes.ConfigValueStr{Value: "heka.example"}
+			config["tls-min-version"] = ctypes.ConfigValueStr{Value: "1.1"}
+			tlsConfig, err := tlsConfigFromConfig(config)
+			So(err, ShouldBeNil)
+			So(tlsConfig.RootCAs, ShouldNotBeNil)
+			So(len(tlsConfig.Certificates), ShouldEqual, 1)
+			So(tlsConfig.ServerName, ShouldEqual, "heka.example")
+			So(tlsConfig.MinVersion, ShouldEqual, tls.VersionTLS11)
+			So(tlsConfig.InsecureSkipVerify, ShouldBeFalse)
+		})
+		Convey("Invalid TLS options should be rejected", func() {
+			config["use-tls"] = ctypes.ConfigValueBool{Value: true}
+			config["tls-min-version"] = ctypes.ConfigValueStr{Value: "0.9"}
+			_, err := tlsConfigFromConfig(config)
+			So(err, ShouldNotBeNil)
+			config["tls-min-version"] = ctypes.ConfigValueStr{Value: "1.2"}
+			config["tls-cert-file"] = ctypes.ConfigValueStr{Value: certFile}
+			_, err = tlsConfigFromConfig(config)
+			So(err, ShouldNotBeNil)
+			delete(config, "tls-cert-file")
+			config["tls-ca-file"] = ctypes.ConfigValueStr{Value: filepath.Join(dir, "missing.pem")}
+			_, err = tlsConfigFromConfig(config)
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Send metrics to a mutual TLS listener", t, func() {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		So(err, ShouldBeNil)
+		pemBytes, err := ioutil.ReadFile(certFile)
+		So(err, ShouldBeNil)
+		pool := x509.NewCertPool()
+		pool.AppendCertsFromPEM(pemBytes)
+		l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			ClientCAs:    pool,
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			// with TLS 1.2 a missing client certificate fails the client handshake
+			MaxVersion: tls.VersionTLS12,
+		})
+		So(err, ShouldBeNil)
+		defer l.Close()
+		received := make(chan []byte, 1)
+		go func() {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+			b := make([]byte, 1)
+			c.Read(b)
+			received <- b
+		}()
+
+		config := map[string]ctypes.ConfigValue{
+			"use-tls":     ctypes.ConfigValueBool{Value: true},
+			"tls-ca-file": ctypes.ConfigValueStr{Value: certFile},
+		}
+		metrics := []plugin.MetricType{
+			*plugin.NewMetricType(core.NewNamespace("intel", "mock", "foo"), time.Now(), nil, "", 1),
+		}
+
+		Convey("A client with a certificate should deliver messages", func() {
+			config["tls-cert-file"] = ctypes.ConfigValueStr{Value: certFile}
+			config["tls-key-file"] = ctypes.ConfigValueStr{Value: keyFile}
+			tlsConfig, err := tlsConfigFromConfig(config)
+			So(err, ShouldBeNil)
+			shc, err := NewSnapHekaClient("tls://"+l.Addr().String(), "")
+			So(err, ShouldBeNil)
+			shc.tlsConfig = tlsConfig
+			So(shc.sendToHeka(metrics), ShouldBeNil)
+			So(<-received, ShouldResemble, []byte{0x1e})
+			hekaConns.closeAll()
+		})
+		Convey("A client without a certificate should be refused", func() {
+			tlsConfig, err := tlsConfigFromConfig(config)
+			So(err, ShouldBeNil)
+			shc, err := NewSnapHekaClient("tls://"+l.Addr().String(), "")
+			So(err, ShouldBeNil)
+			shc.tlsConfig = tlsConfig
+			shc.retry = retryPolicy{maxAttempts: 1}
+			So(shc.sendToHeka(metrics), ShouldNotBeNil)
+			hekaConns.closeAll()
+		})
+	})
+
+	Convey("Clients with different TLS settings should not share connections", t, func() {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		So(err, ShouldBeNil)
+		l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+		So(err, ShouldBeNil)
+		defer l.Close()
+		accepted := acceptAll(l)
+		go func() {
+			for c := range accepted {
+				go c.Read(make([]byte, 1))
+			}
+		}()
+		metrics := mockMetrics(1)
+
+		insecure, err := NewSnapHekaClient("tls://"+l.Addr().String(), "")
+		So(err, ShouldBeNil)
+		insecure.tlsConfig = &tls.Config{InsecureSkipVerify: true}
+		So(insecure.sendToHeka(metrics), ShouldBeNil)
+
+		// the certificate is not trusted without tls-ca-file
+		verifying, err := NewSnapHekaClient("tls://"+l.Addr().String(), "")
+		So(err, ShouldBeNil)
+		verifying.tlsConfig = &tls.Config{}
+		verifying.retry = retryPolicy{maxAttempts: 1}
+		So(verifying.sendToHeka(metrics), ShouldNotBeNil)
+		hekaConns.closeAll()
+	})
+}